@@ -0,0 +1,655 @@
+package flattener
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/timbray/quamina"
+)
+
+// Avro messages on Kafka are framed the way the Confluent schema registry does it:
+// a zero magic byte, the big-endian schema ID and then the Avro binary encoding.
+const avroMagicByte = 0
+const avroHeaderLength = 5
+
+// SchemaResolver resolves the writer schema (as Avro schema JSON) of a message by its schema ID.
+type SchemaResolver interface {
+	Resolve(id uint32) (string, error)
+}
+
+// MemorySchemaResolver is an in-memory SchemaResolver, it stands in for a schema registry
+// in tests and for deployments where the schemas are known upfront.
+type MemorySchemaResolver struct {
+	lock    sync.RWMutex
+	schemas map[uint32]string
+}
+
+// NewMemorySchemaResolver creates a MemorySchemaResolver without schemas.
+func NewMemorySchemaResolver() *MemorySchemaResolver {
+	return &MemorySchemaResolver{schemas: make(map[uint32]string)}
+}
+
+// Register adds the schema JSON of id.
+func (r *MemorySchemaResolver) Register(id uint32, schema string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.schemas[id] = schema
+}
+
+func (r *MemorySchemaResolver) Resolve(id uint32) (string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	schema, ok := r.schemas[id]
+	if !ok {
+		return "", fmt.Errorf("unknown schema id %d", id)
+	}
+	return schema, nil
+}
+
+// AvroFlattener flattens Avro records, decoding only the records, arrays and maps
+// needed by the PathIndex and skipping everything else.
+//
+//	Union values are flattened as the value of the selected branch, which is how
+//	they look in the plain JSON form of the record.
+type AvroFlattener struct {
+	paths    PathIndex
+	resolver SchemaResolver
+
+	// schemas caches parsed schemas by their ID.
+	schemas map[uint32]*avroSchema
+
+	fields     []quamina.Field
+	arrayCount int32
+	arrayTrail []quamina.ArrayPos
+	buf        []byte
+}
+
+// NewAvroFlattener creates a flattener for Avro messages framed with a schema ID,
+// emitting the fields in paths.
+func NewAvroFlattener(paths PathIndex, resolver SchemaResolver) *AvroFlattener {
+	return &AvroFlattener{
+		paths:      paths,
+		resolver:   resolver,
+		schemas:    make(map[uint32]*avroSchema),
+		fields:     make([]quamina.Field, 0),
+		arrayTrail: make([]quamina.ArrayPos, 0),
+		arrayCount: 0,
+	}
+}
+
+func (fa *AvroFlattener) Copy() quamina.Flattener {
+	return NewAvroFlattener(fa.paths, fa.resolver)
+}
+
+func (fa *AvroFlattener) reset() {
+	fa.arrayCount = 0
+	fa.fields = fa.fields[:0]
+	fa.arrayTrail = fa.arrayTrail[:0]
+
+	// Decoded values live in buf, like the fields they are only valid until the next call.
+	fa.buf = fa.buf[:0]
+}
+
+func (fa *AvroFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	fa.reset()
+
+	if len(event) < avroHeaderLength || event[0] != avroMagicByte {
+		return fa.fields, errors.New("avro: missing schema id header")
+	}
+
+	schema, err := fa.schema(binary.BigEndian.Uint32(event[1:avroHeaderLength]))
+	if err != nil {
+		return fa.fields, err
+	}
+
+	r := &avroReader{b: event[avroHeaderLength:]}
+	if err := fa.value(r, schema, nil, fa.paths); err != nil {
+		return fa.fields, err
+	}
+
+	return fa.fields, nil
+}
+
+func (fa *AvroFlattener) schema(id uint32) (*avroSchema, error) {
+	if s, ok := fa.schemas[id]; ok {
+		return s, nil
+	}
+
+	raw, err := fa.resolver.Resolve(id)
+	if err != nil {
+		return nil, fmt.Errorf("avro: resolving schema: %s", err)
+	}
+
+	s, err := parseAvroSchema(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	fa.schemas[id] = s
+	return s, nil
+}
+
+// value flattens a single value of schema s.
+//
+//	path is set when the value is a field in the index, n is set when it's a node.
+func (fa *AvroFlattener) value(r *avroReader, s *avroSchema, path []byte, n Node) error {
+	switch s.typ {
+	case avroUnion:
+		idx, err := r.long()
+		if err != nil {
+			return err
+		}
+		if idx < 0 || int(idx) >= len(s.branches) {
+			return fmt.Errorf("avro: union branch %d out of range", idx)
+		}
+		return fa.value(r, s.branches[idx], path, n)
+
+	case avroRecord:
+		if n == nil {
+			return r.skip(s)
+		}
+		return fa.traverseRecord(r, s, n)
+
+	case avroMap:
+		if n == nil {
+			return r.skip(s)
+		}
+		return fa.traverseMap(r, s, n)
+
+	case avroArray:
+		if path == nil && n == nil {
+			return r.skip(s)
+		}
+		return fa.traverseArray(r, s, path, n)
+	}
+
+	if path == nil {
+		return r.skip(s)
+	}
+
+	start := len(fa.buf)
+	var err error
+	fa.buf, err = r.appendJSON(fa.buf, s)
+	if err != nil {
+		return err
+	}
+
+	fa.storeField(path, fa.buf[start:len(fa.buf):len(fa.buf)])
+	return nil
+}
+
+func (fa *AvroFlattener) traverseRecord(r *avroReader, s *avroSchema, n Node) error {
+	nodeFields := n.getFields()
+
+	for i := range s.fields {
+		f := &s.fields[i]
+
+		path := nodeFields[f.name]
+		node, isNode := n.get(f.name)
+		if !isNode {
+			node = nil
+		}
+
+		if err := fa.value(r, f.schema, path, node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// In JSON a map is an object, so map keys are looked up in the node like record fields.
+func (fa *AvroFlattener) traverseMap(r *avroReader, s *avroSchema, n Node) error {
+	nodeFields := n.getFields()
+
+	return r.blocks(func() error {
+		key, err := r.bytes()
+		if err != nil {
+			return err
+		}
+
+		path := nodeFields[BinaryString(key)]
+		node, isNode := n.get(BinaryString(key))
+		if !isNode {
+			node = nil
+		}
+
+		return fa.value(r, s.values, path, node)
+	})
+}
+
+func (fa *AvroFlattener) traverseArray(r *avroReader, s *avroSchema, path []byte, n Node) error {
+	fa.arrayCount++
+	fa.arrayTrail = append(fa.arrayTrail, quamina.ArrayPos{Array: fa.arrayCount, Pos: 0})
+	defer func() {
+		fa.arrayTrail = fa.arrayTrail[:len(fa.arrayTrail)-1]
+	}()
+
+	return r.blocks(func() error {
+		fa.arrayTrail[len(fa.arrayTrail)-1].Pos++
+		return fa.value(r, s.items, path, n)
+	})
+}
+
+func (fa *AvroFlattener) storeField(path []byte, val []byte) {
+	f := quamina.Field{Path: path, Val: val}
+	if len(fa.arrayTrail) > 0 {
+		f.ArrayTrail = make([]quamina.ArrayPos, len(fa.arrayTrail))
+		copy(f.ArrayTrail, fa.arrayTrail)
+	}
+	fa.fields = append(fa.fields, f)
+}
+
+type avroType int
+
+const (
+	avroNull avroType = iota
+	avroBoolean
+	avroInt
+	avroLong
+	avroFloat
+	avroDouble
+	avroBytes
+	avroString
+	avroRecord
+	avroEnum
+	avroArray
+	avroMap
+	avroUnion
+	avroFixed
+)
+
+var avroPrimitives = map[string]avroType{
+	"null":    avroNull,
+	"boolean": avroBoolean,
+	"int":     avroInt,
+	"long":    avroLong,
+	"float":   avroFloat,
+	"double":  avroDouble,
+	"bytes":   avroBytes,
+	"string":  avroString,
+}
+
+type avroSchema struct {
+	typ avroType
+
+	fields   []avroField   // record
+	symbols  []string      // enum
+	items    *avroSchema   // array
+	values   *avroSchema   // map
+	branches []*avroSchema // union
+	size     int           // fixed
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+// parseAvroSchema parses Avro schema JSON, named types may be referenced (also recursively)
+// by their full name or, within the same namespace, by their short name.
+func parseAvroSchema(raw string) (*avroSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil, fmt.Errorf("avro: parsing schema: %s", err)
+	}
+
+	p := avroSchemaParser{named: make(map[string]*avroSchema)}
+	return p.parse(v, "")
+}
+
+type avroSchemaParser struct {
+	named map[string]*avroSchema
+}
+
+func (p avroSchemaParser) parse(v interface{}, namespace string) (*avroSchema, error) {
+	switch t := v.(type) {
+	case string:
+		if typ, ok := avroPrimitives[t]; ok {
+			return &avroSchema{typ: typ}, nil
+		}
+		if s, ok := p.named[avroFullName(t, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := p.named[t]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("avro: unknown type %q", t)
+
+	case []interface{}:
+		s := &avroSchema{typ: avroUnion}
+		for _, b := range t {
+			branch, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, branch)
+		}
+		return s, nil
+
+	case map[string]interface{}:
+		return p.parseComplex(t, namespace)
+	}
+
+	return nil, fmt.Errorf("avro: invalid schema %v", v)
+}
+
+func (p avroSchemaParser) parseComplex(t map[string]interface{}, namespace string) (*avroSchema, error) {
+	typ, _ := t["type"].(string)
+
+	// Named types get their own namespace, which is inherited by the types defined inside them.
+	name, _ := t["name"].(string)
+	if ns, ok := t["namespace"].(string); ok {
+		namespace = ns
+	}
+	if name != "" {
+		name = avroFullName(name, namespace)
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			namespace = name[:i]
+		}
+	}
+
+	switch typ {
+	case "record", "error":
+		s := &avroSchema{typ: avroRecord}
+		p.named[name] = s
+
+		fields, _ := t["fields"].([]interface{})
+		for _, f := range fields {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("avro: invalid field in %s", name)
+			}
+			fieldName, _ := fm["name"].(string)
+			fieldSchema, err := p.parse(fm["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.fields = append(s.fields, avroField{name: fieldName, schema: fieldSchema})
+		}
+		return s, nil
+
+	case "enum":
+		s := &avroSchema{typ: avroEnum}
+		symbols, _ := t["symbols"].([]interface{})
+		for _, sym := range symbols {
+			str, _ := sym.(string)
+			s.symbols = append(s.symbols, str)
+		}
+		p.named[name] = s
+		return s, nil
+
+	case "fixed":
+		size, _ := t["size"].(float64)
+		s := &avroSchema{typ: avroFixed, size: int(size)}
+		p.named[name] = s
+		return s, nil
+
+	case "array":
+		items, err := p.parse(t["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: avroArray, items: items}, nil
+
+	case "map":
+		values, err := p.parse(t["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: avroMap, values: values}, nil
+	}
+
+	// {"type": "string", "logicalType": ...} and friends.
+	return p.parse(t["type"], namespace)
+}
+
+func avroFullName(name string, namespace string) string {
+	if strings.ContainsRune(name, '.') || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroReader reads the Avro binary encoding.
+type avroReader struct {
+	b   []byte
+	pos int
+}
+
+var errAvroShort = errors.New("avro: unexpected end of data")
+
+func (r *avroReader) long() (int64, error) {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		return 0, errAvroShort
+	}
+	r.pos += n
+
+	// zig-zag decoding
+	return int64(v>>1) ^ -int64(v&1), nil
+}
+
+func (r *avroReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.b)-r.pos < n {
+		return nil, errAvroShort
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *avroReader) bytes() ([]byte, error) {
+	n, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	return r.next(int(n))
+}
+
+// blockCount reads the item count of the next block of an array or a map, zero ends them
+// and a negative count is followed by the block size in bytes.
+//
+//	Items may take no bytes at all (null, an empty record), so a huge count in a malformed
+//	message would loop without consuming it. Counts are capped by the bytes left, more
+//	zero-size items than that are rejected too.
+func (r *avroReader) blockCount() (int64, error) {
+	count, err := r.long()
+	if err != nil {
+		return 0, err
+	}
+
+	if left := int64(len(r.b) - r.pos); count > left || count < -left {
+		return 0, fmt.Errorf("avro: block of %d items with %d bytes left", count, left)
+	}
+	return count, nil
+}
+
+// blocks iterates the items of an array or map, which are encoded as a series of blocks.
+func (r *avroReader) blocks(item func() error) error {
+	for {
+		count, err := r.blockCount()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+
+		// A negative count is followed by the block size in bytes.
+		if count < 0 {
+			count = -count
+			if _, err := r.long(); err != nil {
+				return err
+			}
+		}
+
+		for i := int64(0); i < count; i++ {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skip skips a value without decoding it.
+func (r *avroReader) skip(s *avroSchema) error {
+	var err error
+
+	switch s.typ {
+	case avroNull:
+	case avroBoolean:
+		_, err = r.next(1)
+	case avroInt, avroLong, avroEnum:
+		_, err = r.long()
+	case avroFloat:
+		_, err = r.next(4)
+	case avroDouble:
+		_, err = r.next(8)
+	case avroBytes, avroString:
+		_, err = r.bytes()
+	case avroFixed:
+		_, err = r.next(s.size)
+	case avroRecord:
+		for i := range s.fields {
+			if err = r.skip(s.fields[i].schema); err != nil {
+				return err
+			}
+		}
+	case avroUnion:
+		var idx int64
+		if idx, err = r.long(); err != nil {
+			return err
+		}
+		if idx < 0 || int(idx) >= len(s.branches) {
+			return fmt.Errorf("avro: union branch %d out of range", idx)
+		}
+		err = r.skip(s.branches[idx])
+	case avroArray, avroMap:
+		err = r.skipBlocks(s)
+	}
+
+	return err
+}
+
+// skipBlocks skips an array or a map, jumping over blocks which were written with their size.
+func (r *avroReader) skipBlocks(s *avroSchema) error {
+	for {
+		count, err := r.blockCount()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+
+		if count < 0 {
+			size, err := r.long()
+			if err != nil {
+				return err
+			}
+			if _, err := r.next(int(size)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i := int64(0); i < count; i++ {
+			if s.typ == avroMap {
+				if _, err := r.bytes(); err != nil {
+					return err
+				}
+				if err := r.skip(s.values); err != nil {
+					return err
+				}
+			} else if err := r.skip(s.items); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// appendJSON decodes a primitive value (or enum/fixed) and appends its JSON form.
+func (r *avroReader) appendJSON(dst []byte, s *avroSchema) ([]byte, error) {
+	switch s.typ {
+	case avroNull:
+		return append(dst, "null"...), nil
+
+	case avroBoolean:
+		b, err := r.next(1)
+		if err != nil {
+			return dst, err
+		}
+		return strconv.AppendBool(dst, b[0] != 0), nil
+
+	case avroInt, avroLong:
+		v, err := r.long()
+		if err != nil {
+			return dst, err
+		}
+		return strconv.AppendInt(dst, v, 10), nil
+
+	case avroFloat:
+		b, err := r.next(4)
+		if err != nil {
+			return dst, err
+		}
+		return appendJSONFloat(dst, float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32), nil
+
+	case avroDouble:
+		b, err := r.next(8)
+		if err != nil {
+			return dst, err
+		}
+		return appendJSONFloat(dst, math.Float64frombits(binary.LittleEndian.Uint64(b)), 64), nil
+
+	case avroString:
+		b, err := r.bytes()
+		if err != nil {
+			return dst, err
+		}
+		return appendJSONString(dst, BinaryString(b), false), nil
+
+	case avroBytes, avroFixed:
+		var b []byte
+		var err error
+		if s.typ == avroBytes {
+			b, err = r.bytes()
+		} else {
+			b, err = r.next(s.size)
+		}
+		if err != nil {
+			return dst, err
+		}
+		return appendAvroBytes(dst, b), nil
+
+	case avroEnum:
+		v, err := r.long()
+		if err != nil {
+			return dst, err
+		}
+		if v < 0 || int(v) >= len(s.symbols) {
+			return dst, fmt.Errorf("avro: enum symbol %d out of range", v)
+		}
+		return appendJSONString(dst, s.symbols[v], false), nil
+	}
+
+	return dst, fmt.Errorf("avro: can't render %d as a JSON value", s.typ)
+}
+
+// appendAvroBytes renders bytes the way the Avro JSON encoding does, every byte is
+// the code point of the same value.
+func appendAvroBytes(dst []byte, b []byte) []byte {
+	var runes strings.Builder
+	for _, c := range b {
+		runes.WriteRune(rune(c))
+	}
+	return appendJSONString(dst, runes.String(), false)
+}
@@ -0,0 +1,171 @@
+package flattener
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+const avroOrderSchema = `{
+  "type": "record", "name": "Order", "namespace": "shop",
+  "fields": [
+    {"name": "id", "type": "string"},
+    {"name": "amount", "type": ["null", "double"]},
+    {"name": "payload", "type": "bytes"},
+    {"name": "tags", "type": {"type": "array", "items": "string"}},
+    {"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "SHIPPED"]}},
+    {"name": "customer", "type": {
+      "type": "record", "name": "Customer",
+      "fields": [
+        {"name": "name", "type": "string"},
+        {"name": "attributes", "type": {"type": "map", "values": "long"}}
+      ]
+    }},
+    {"name": "items", "type": {"type": "array", "items": {
+      "type": "record", "name": "Item",
+      "fields": [
+        {"name": "sku", "type": "string"},
+        {"name": "qty", "type": "int"}
+      ]
+    }}},
+    {"name": "previous", "type": ["null", "Order"]}
+  ]
+}`
+
+type avroWriter struct {
+	b []byte
+}
+
+func (w *avroWriter) long(v int64) *avroWriter {
+	w.b = binary.AppendUvarint(w.b, uint64((v<<1)^(v>>63)))
+	return w
+}
+
+func (w *avroWriter) str(s string) *avroWriter {
+	w.long(int64(len(s)))
+	w.b = append(w.b, s...)
+	return w
+}
+
+func (w *avroWriter) double(f float64) *avroWriter {
+	w.b = binary.LittleEndian.AppendUint64(w.b, math.Float64bits(f))
+	return w
+}
+
+func avroOrder(schemaID uint32) []byte {
+	w := &avroWriter{b: []byte{avroMagicByte}}
+	w.b = binary.BigEndian.AppendUint32(w.b, schemaID)
+
+	w.str("order-1")
+	w.long(1).double(99.5)
+	w.str("\x00\x01binary")
+	w.long(2).str("red").str("big").long(0)
+	w.long(1)
+
+	// customer, the attributes map is written as a sized block.
+	w.str("Yosi")
+	entries := &avroWriter{}
+	entries.str("visits").long(12)
+	w.long(-1).long(int64(len(entries.b)))
+	w.b = append(w.b, entries.b...)
+	w.long(0)
+
+	w.long(2).str("sku-1").long(3).str("sku-2").long(1).long(0)
+
+	// previous order, which is never part of the index.
+	w.long(1)
+	w.str("order-0").long(0).str("").long(0).long(0).str("Yosi").long(0).long(0).long(0)
+
+	return w.b
+}
+
+func Test_Avro_Flatten(t *testing.T) {
+	resolver := NewMemorySchemaResolver()
+	resolver.Register(7, avroOrderSchema)
+
+	paths := NewPaths()
+	for _, path := range []string{"id", "amount", "tags", "status", "customer\nattributes\nvisits", "items\nsku"} {
+		paths.Add(path)
+	}
+
+	fields, err := NewAvroFlattener(paths, resolver).Flatten(avroOrder(7), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := []quamina.Field{
+		{Path: []byte("id"), Val: []byte(`"order-1"`)},
+		{Path: []byte("amount"), Val: []byte(`99.5`)},
+		{Path: []byte("tags"), Val: []byte(`"red"`), ArrayTrail: []quamina.ArrayPos{{Array: 1, Pos: 1}}},
+		{Path: []byte("tags"), Val: []byte(`"big"`), ArrayTrail: []quamina.ArrayPos{{Array: 1, Pos: 2}}},
+		{Path: []byte("status"), Val: []byte(`"SHIPPED"`)},
+		{Path: []byte("customer\nattributes\nvisits"), Val: []byte(`12`)},
+		{Path: []byte("items\nsku"), Val: []byte(`"sku-1"`), ArrayTrail: []quamina.ArrayPos{{Array: 2, Pos: 1}}},
+		{Path: []byte("items\nsku"), Val: []byte(`"sku-2"`), ArrayTrail: []quamina.ArrayPos{{Array: 2, Pos: 2}}},
+	}
+
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+}
+
+func Test_Avro_UnknownSchema(t *testing.T) {
+	fa := NewAvroFlattener(NewPaths(), NewMemorySchemaResolver())
+
+	if _, err := fa.Flatten(avroOrder(3), nil); err == nil {
+		t.Error("wanted error for unregistered schema")
+	}
+	if _, err := fa.Flatten([]byte(`{"id": 1}`), nil); err == nil {
+		t.Error("wanted error for message without header")
+	}
+}
+
+func Test_Avro_Truncated(t *testing.T) {
+	resolver := NewMemorySchemaResolver()
+	resolver.Register(7, avroOrderSchema)
+
+	paths := NewPaths()
+	paths.Add("items\nsku")
+
+	event := avroOrder(7)
+	if _, err := NewAvroFlattener(paths, resolver).Flatten(event[:len(event)-20], nil); err == nil {
+		t.Error("wanted error for truncated message")
+	}
+}
+
+func Test_Avro_BlockCount(t *testing.T) {
+	resolver := NewMemorySchemaResolver()
+	resolver.Register(1, `{"type": "record", "name": "Nulls", "fields": [
+		{"name": "n", "type": {"type": "array", "items": "null"}},
+		{"name": "id", "type": "string"}
+	]}`)
+
+	event := func(count int64) []byte {
+		w := &avroWriter{b: []byte{avroMagicByte, 0, 0, 0, 1}}
+		w.long(count)
+		if count != 0 {
+			w.long(0)
+		}
+		return w.str("x").b
+	}
+
+	// Null items take no bytes, a huge count has to fail instead of looping, whether the
+	// array is traversed or skipped.
+	for _, path := range []string{"n", "id"} {
+		paths := NewPaths()
+		paths.Add(path)
+		fa := NewAvroFlattener(paths, resolver)
+
+		if _, err := fa.Flatten(event(2), nil); err != nil {
+			t.Errorf("%s: Flatten: %s", path, err)
+		}
+		if _, err := fa.Flatten(event(1<<60), nil); err == nil {
+			t.Errorf("%s: wanted error for a huge block count", path)
+		}
+		if _, err := fa.Flatten(event(-(1 << 60)), nil); err == nil {
+			t.Errorf("%s: wanted error for a huge sized block count", path)
+		}
+	}
+}
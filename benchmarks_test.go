@@ -1,4 +1,4 @@
-package main
+package flattener
 
 import (
 	"bufio"
@@ -65,7 +65,6 @@ func TestCRANLEIGH(t *testing.T) {
 	if err != nil {
 		t.Error("!? " + err.Error())
 	}
-	fmt.Println(m.MatcherStats())
 
 	var matches []quamina.X
 	lines := [][]byte{[]byte(jCranleigh), []byte(j108492)}
@@ -121,17 +120,11 @@ func TestBigShellStyle(t *testing.T) {
 			}
 		}
 	*/
-	fmt.Println(m.MatcherStats())
 
 	lCounts := make(map[quamina.X]int)
 	before := time.Now()
-	fj := quamina.NewJSONFlattener()
 	for _, line := range lines {
-		fields, err := fj.Flatten(line, m)
-		if err != nil {
-			t.Error("Flatten: " + err.Error())
-		}
-		matches, err := m.MatchesForFields(fields)
+		matches, err := m.MatchesForEvent(line)
 		if err != nil {
 			t.Error("Matches4JSON: " + err.Error())
 		}
@@ -200,7 +193,6 @@ func TestPatternAddition(t *testing.T) {
 	runtime.ReadMemStats(&msAfter)
 	delta := 1.0 / 1000000.0 * float64(msAfter.Alloc-msBefore.Alloc)
 	fmt.Printf("before %d, after %d, delta %f\n", msBefore.Alloc, msAfter.Alloc, delta)
-	fmt.Println("stats:" + m.MatcherStats())
 	elapsed := float64(time.Since(before).Milliseconds())
 	perSecond := float64(fieldCount) / (elapsed / 1000.0)
 	fmt.Printf("%.2f fields/second\n\n", perSecond)
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/timbray/quamina"
+	flattener "github.com/yosiat/quamina-flatenner"
+)
+
+func runFlatten(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("flatten", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	var patternFiles, dotted listFlag
+	fs.Var(&patternFiles, "pattern", "file of quamina patterns whose paths are flattened, can be repeated")
+	fs.Var(&dotted, "path", "path to flatten, segments separated by dots (a.b), can be repeated")
+	format := fs.String("format", "table", "output format, table or json (JSON lines)")
+	lenient := fs.Bool("lenient", false, "accept JSONC / JSON5-like events")
+	compare := fs.Bool("compare", false, "print the patterns matched differently by quamina's flattener instead of the fields")
+	trace := fs.Bool("trace", false, "print the steps of flattening every event on stderr")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(stderr, "flatten: unknown format %q\n", *format)
+		return 2
+	}
+
+	paths, err := collectPaths(patternFiles, dotted)
+	if err != nil {
+		fmt.Fprintf(stderr, "flatten: %s\n", err)
+		return 1
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(stderr, "flatten: no paths, use -pattern or -path")
+		return 2
+	}
+
+	inputs, err := readInputs(fs.Args(), stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "flatten: %s\n", err)
+		return 1
+	}
+
+	index := flattener.NewPaths()
+	for _, path := range paths {
+		index.Add(path)
+	}
+
+	var opts []flattener.Option
+	if *lenient {
+		opts = append(opts, flattener.WithLenientJSON())
+	}
+	if *trace {
+		opts = append(opts, flattener.WithTracer(flattener.NewLogTracer(log.New(stderr, "", 0))))
+	}
+	fj := flattener.NewJxFlattener(index, opts...)
+
+	var cmp *comparer
+	if *compare {
+		if cmp, err = newComparer(patternFiles, paths, fj.Copy()); err != nil {
+			fmt.Fprintf(stderr, "flatten: %s\n", err)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, in := range inputs {
+		events, err := fj.FlattenAll(in.data)
+		if err != nil {
+			fmt.Fprintf(stderr, "flatten: %s: %s\n", in.name, err)
+			status = 1
+		}
+
+		for i, event := range events {
+			source := fmt.Sprintf("%s #%d", in.name, i+1)
+
+			if cmp != nil {
+				if !cmp.compare(stdout, source, in.data[event.Start:event.End]) {
+					status = 1
+				}
+				continue
+			}
+
+			if *format == "json" {
+				err = writeFieldsJSON(stdout, in.name, i+1, event.Fields)
+			} else {
+				err = writeFieldsTable(stdout, source, event)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "flatten: %s\n", err)
+				return 1
+			}
+		}
+	}
+
+	if cmp != nil {
+		fmt.Fprintf(stdout, "compared %d events, %d differ\n", cmp.events, cmp.differ)
+	}
+
+	return status
+}
+
+func writeFieldsTable(w io.Writer, source string, event flattener.FlattenedEvent) error {
+	fmt.Fprintf(w, "== %s (bytes %d-%d)\n", source, event.Start, event.End)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tVALUE\tARRAY TRAIL")
+	for _, f := range event.Fields {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", displayPath(f.Path), f.Val, formatTrail(f.ArrayTrail))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+type jsonField struct {
+	Source string          `json:"source"`
+	Event  int             `json:"event"`
+	Path   string          `json:"path"`
+	Value  json.RawMessage `json:"value"`
+	Trail  []jsonArrayPos  `json:"trail,omitempty"`
+}
+
+type jsonArrayPos struct {
+	Array int32 `json:"array"`
+	Pos   int32 `json:"pos"`
+}
+
+func writeFieldsJSON(w io.Writer, source string, event int, fields []quamina.Field) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, f := range fields {
+		jf := jsonField{Source: source, Event: event, Path: displayPath(f.Path), Value: f.Val}
+		if !json.Valid(f.Val) {
+			// Values are raw JSON, anything else (a bare lenient value) is written as a string.
+			jf.Value, _ = json.Marshal(string(f.Val))
+		}
+		for _, pos := range f.ArrayTrail {
+			jf.Trail = append(jf.Trail, jsonArrayPos{Array: pos.Array, Pos: pos.Pos})
+		}
+
+		if err := enc.Encode(jf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formatTrail renders an ArrayTrail as "[array:pos ...]".
+func formatTrail(trail []quamina.ArrayPos) string {
+	if len(trail) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(trail))
+	for i, pos := range trail {
+		parts[i] = fmt.Sprintf("%d:%d", pos.Array, pos.Pos)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// comparer matches the events with quamina's own flattener and with the jx one, and
+// diffs the matches.
+//
+//	quamina doesn't expose its flattener, so fields can't be compared directly. Instead
+//	every pattern of the pattern files is matched, along with an exists pattern for every
+//	path, so a path missing on one side shows up without any pattern.
+type comparer struct {
+	q  *quamina.Quamina
+	qj *quamina.Quamina
+
+	events int
+	differ int
+}
+
+func newComparer(patternFiles []string, paths []string, fj quamina.Flattener) (*comparer, error) {
+	q, err := quamina.New()
+	if err != nil {
+		return nil, fmt.Errorf("newComparer: %s", err)
+	}
+	qj, err := quamina.New(quamina.WithFlattener(fj))
+	if err != nil {
+		return nil, fmt.Errorf("newComparer: %s", err)
+	}
+	c := &comparer{q: q, qj: qj}
+
+	for _, file := range patternFiles {
+		patterns, err := readPatterns(file)
+		if err != nil {
+			return nil, err
+		}
+		for i, pattern := range patterns {
+			if err := c.addPattern(fmt.Sprintf("%s #%d", file, i+1), pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if err := c.addPattern("exists "+displayPath([]byte(path)), existsPattern(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *comparer) addPattern(name string, pattern string) error {
+	if err := c.q.AddPattern(name, pattern); err != nil {
+		return fmt.Errorf("addPattern: %s: %s", name, err)
+	}
+	return c.qj.AddPattern(name, pattern)
+}
+
+// existsPattern returns a pattern matching events where path exists.
+func existsPattern(path string) string {
+	parts := strings.Split(path, flattener.PATH_SEPARATOR)
+
+	var b strings.Builder
+	for _, part := range parts {
+		key, _ := json.Marshal(part)
+		fmt.Fprintf(&b, "{%s: ", key)
+	}
+	b.WriteString(`[{"exists": true}]`)
+	b.WriteString(strings.Repeat("}", len(parts)))
+	return b.String()
+}
+
+// compare matches the event with both flatteners and prints the differences, returning
+// whether there were none.
+func (c *comparer) compare(w io.Writer, source string, event []byte) bool {
+	c.events++
+
+	wanted, err := c.q.MatchesForEvent(event)
+	if err != nil {
+		c.differ++
+		fmt.Fprintf(w, "== %s: quamina's flattener failed: %s\n", source, err)
+		return false
+	}
+	got, err := c.qj.MatchesForEvent(event)
+	if err != nil {
+		c.differ++
+		fmt.Fprintf(w, "== %s: %s\n", source, err)
+		return false
+	}
+
+	missing, extra := diffMatches(wanted, got)
+	if len(missing) == 0 && len(extra) == 0 {
+		return true
+	}
+
+	c.differ++
+	fmt.Fprintf(w, "== %s\n", source)
+	for _, x := range missing {
+		fmt.Fprintf(w, "- %s\n", x)
+	}
+	for _, x := range extra {
+		fmt.Fprintf(w, "+ %s\n", x)
+	}
+	return false
+}
+
+// diffMatches returns the patterns only in wanted (missing) and only in got (extra), both
+// sorted.
+func diffMatches(wanted, got []quamina.X) (missing, extra []string) {
+	seen := make(map[string]int)
+	for _, x := range wanted {
+		seen[x.(string)]++
+	}
+	for _, x := range got {
+		seen[x.(string)]--
+	}
+
+	for x, n := range seen {
+		if n > 0 {
+			missing = append(missing, x)
+		} else if n < 0 {
+			extra = append(extra, x)
+		}
+	}
+
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func runCommand(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	status := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func Test_Flatten_Table(t *testing.T) {
+	patterns := writeFile(t, "patterns.json", []byte(`{"a": {"b": ["x"]}}
+{"c": [{"exists": true}]}`))
+
+	status, stdout, stderr := runCommand(t, `{"a": {"b": "x", "z": 1}, "c": [1, 2]} {"c": 3}`, "flatten", "-pattern", patterns)
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, stderr)
+	}
+
+	wanted := `== stdin #1 (bytes 0-38)
+PATH  VALUE  ARRAY TRAIL
+a->b  "x"
+c     1      [1:1]
+c     2      [1:2]
+
+== stdin #2 (bytes 39-47)
+PATH  VALUE  ARRAY TRAIL
+c     3
+
+`
+	// The empty trail column leaves padding at the end of the line.
+	got := stdout
+	for strings.Contains(got, " \n") {
+		got = strings.ReplaceAll(got, " \n", "\n")
+	}
+	if got != wanted {
+		t.Errorf("wanted:\n%s\ngot:\n%s", wanted, got)
+	}
+}
+
+func Test_Flatten_JSONLines(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("{\"a\": {\"b\": [\"x\"]}}\n{\"a\": {\"b\": \"y\"}}\n"))
+	_ = zw.Close()
+	events := writeFile(t, "events.json.gz", gz.Bytes())
+
+	status, stdout, stderr := runCommand(t, "", "flatten", "-path", "a.b", "-format", "json", events)
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, stderr)
+	}
+
+	wanted := []string{
+		`{"source":"` + events + `","event":1,"path":"a->b","value":"x","trail":[{"array":1,"pos":1}]}`,
+		`{"source":"` + events + `","event":2,"path":"a->b","value":"y"}`,
+	}
+	if got := strings.Split(strings.TrimSpace(stdout), "\n"); !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %q got %q", wanted, got)
+	}
+}
+
+func Test_Flatten_Compare(t *testing.T) {
+	status, stdout, stderr := runCommand(t, `{"a": {"b": "x"}, "c": 1, "b": 2}`, "flatten", "-path", "a.b", "-path", "c", "-compare")
+	if status != 0 {
+		t.Fatalf("status %d: %s%s", status, stdout, stderr)
+	}
+	if wanted := "compared 1 events, 0 differ\n"; stdout != wanted {
+		t.Errorf("wanted %q got %q", wanted, stdout)
+	}
+}
+
+func Test_Flatten_ComparePatterns(t *testing.T) {
+	patterns := writeFile(t, "patterns.json", []byte(`{"a": {"b": [{"shellstyle": "y*"}]}}
+{"c": [2]}`))
+
+	status, stdout, stderr := runCommand(t, `{"a": {"b": "x"}, "c": 1} {"a": {"b": ["x", "y"]}, "c": [0, 2]}`, "flatten", "-pattern", patterns, "-compare")
+	if status != 0 {
+		t.Fatalf("status %d: %s%s", status, stdout, stderr)
+	}
+	if wanted := "compared 2 events, 0 differ\n"; stdout != wanted {
+		t.Errorf("wanted %q got %q", wanted, stdout)
+	}
+}
+
+func Test_Flatten_DiffMatches(t *testing.T) {
+	missing, extra := diffMatches([]quamina.X{"p #2", "exists a->b", "p #1"}, []quamina.X{"p #1", "exists c"})
+	if w := []string{"exists a->b", "p #2"}; !reflect.DeepEqual(missing, w) {
+		t.Errorf("missing: wanted %q got %q", w, missing)
+	}
+	if w := []string{"exists c"}; !reflect.DeepEqual(extra, w) {
+		t.Errorf("extra: wanted %q got %q", w, extra)
+	}
+}
+
+func Test_Flatten_Errors(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		status int
+	}{
+		{nil, 2},
+		{[]string{"unknown"}, 2},
+		{[]string{"flatten"}, 2},
+		{[]string{"flatten", "-path", "a", "-format", "xml"}, 2},
+		{[]string{"flatten", "-pattern", "missing.json"}, 1},
+		{[]string{"flatten", "-path", "a", "missing.json"}, 1},
+	} {
+		if status, _, _ := runCommand(t, "", c.args...); status != c.status {
+			t.Errorf("%q: wanted status %d got %d", c.args, c.status, status)
+		}
+	}
+
+	if status, _, stderr := runCommand(t, `{"a": 1} {"a": `, "flatten", "-path", "a"); status != 1 || !strings.Contains(stderr, "stdin") {
+		t.Errorf("wanted failure for an unterminated event, got %d: %s", status, stderr)
+	}
+}
+
+func Test_Flatten_Trace(t *testing.T) {
+	status, _, stderr := runCommand(t, `{"z": 1, "a": {"b": "x"}}`, "flatten", "-path", "a.b", "-trace")
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, stderr)
+	}
+
+	for _, line := range []string{`  key skipped "z"`, `    field a->b = "x"`} {
+		if !strings.Contains(stderr, line+"\n") {
+			t.Errorf("missing %q in the trace:\n%s", line, stderr)
+		}
+	}
+}
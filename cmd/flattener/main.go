@@ -0,0 +1,176 @@
+// Command flattener runs the flattener from the command line, to see which fields it
+// produces for events.
+//
+//	flattener flatten -pattern patterns.json [-path a.b] [-format table|json] [-compare] [-trace] [files...]
+//	flattener match -patterns patterns.yaml|dir [-split dir] [-all] [files...]
+//	flattener serve [-addr :8080] [-patterns patterns.yaml|dir] [-reload 5s]
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	flattener "github.com/yosiat/quamina-flatenner"
+)
+
+const usage = `usage: flattener <command> [flags] [files...]
+
+commands:
+  flatten   print the fields of events
+  match     match NDJSON events against named patterns
+  serve     match events over HTTP
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes a command, returning the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "flatten":
+		return runFlatten(args[1:], stdin, stdout, stderr)
+	case "match":
+		return runMatch(args[1:], stdin, stdout, stderr)
+	case "serve":
+		return runServe(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "flattener: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// listFlag is a flag which can be given several times.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// input is a file (or stdin) holding events.
+type input struct {
+	name string
+	data []byte
+}
+
+// readInputs reads the files, or stdin when there are none ("-" is stdin as well).
+// Gzipped files are decompressed.
+func readInputs(files []string, stdin io.Reader) ([]input, error) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	inputs := make([]input, 0, len(files))
+	for _, file := range files {
+		var data []byte
+		var err error
+		if file == "-" {
+			file = "stdin"
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("readInputs: %s", err)
+		}
+
+		if data, err = gunzipIfNeeded(data); err != nil {
+			return nil, fmt.Errorf("readInputs: %s: %s", file, err)
+		}
+		inputs = append(inputs, input{name: file, data: data})
+	}
+
+	return inputs, nil
+}
+
+func gunzipIfNeeded(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// readPatterns reads the patterns in a file, one or more JSON objects (like NDJSON).
+func readPatterns(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("readPatterns: %s", err)
+	}
+
+	patterns, err := splitPatterns(data)
+	if err != nil {
+		return nil, fmt.Errorf("readPatterns: %s: %s", file, err)
+	}
+	return patterns, nil
+}
+
+// splitPatterns splits concatenated JSON patterns.
+func splitPatterns(data []byte) ([]string, error) {
+	var patterns []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return patterns, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, string(raw))
+	}
+}
+
+// collectPaths returns the paths of the pattern files and of the dotted paths ("a.b").
+func collectPaths(patternFiles []string, dotted []string) ([]string, error) {
+	var paths []string
+	for _, file := range patternFiles {
+		patterns, err := readPatterns(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pattern := range patterns {
+			patternPaths, err := flattener.PatternPaths([]byte(pattern))
+			if err != nil {
+				return nil, fmt.Errorf("collectPaths: %s: %s", file, err)
+			}
+			paths = append(paths, patternPaths...)
+		}
+	}
+
+	for _, path := range dotted {
+		paths = append(paths, strings.ReplaceAll(path, ".", flattener.PATH_SEPARATOR))
+	}
+
+	return paths, nil
+}
+
+// displayPath renders a path for humans, "a->b".
+func displayPath(path []byte) string {
+	return strings.ReplaceAll(string(path), flattener.PATH_SEPARATOR, "->")
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	flattener "github.com/yosiat/quamina-flatenner"
+)
+
+// maxEventSize limits the length of an NDJSON line.
+const maxEventSize = 16 * 1024 * 1024
+
+func runMatch(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("match", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	patternsFrom := fs.String("patterns", "", "directory of pattern files (named by the file) or a YAML file of named patterns")
+	split := fs.String("split", "", "directory to write the events matching each pattern to, as <name>.ndjson")
+	all := fs.Bool("all", false, "also write the events which match no pattern")
+	lenient := fs.Bool("lenient", false, "accept JSONC / JSON5-like events")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *patternsFrom == "" {
+		fmt.Fprintln(stderr, "match: no patterns, use -patterns")
+		return 2
+	}
+	if *split != "" && *all {
+		fmt.Fprintln(stderr, "match: -all can't be used with -split, events without matches have no file")
+		return 2
+	}
+
+	patterns, err := loadNamedPatterns(*patternsFrom)
+	if err != nil {
+		fmt.Fprintf(stderr, "match: %s\n", err)
+		return 1
+	}
+
+	var opts []flattener.Option
+	if *lenient {
+		opts = append(opts, flattener.WithLenientJSON())
+	}
+	m, err := flattener.NewMatcher(opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "match: %s\n", err)
+		return 1
+	}
+	for _, p := range patterns {
+		if err := m.AddPattern(p.name, p.pattern); err != nil {
+			fmt.Fprintf(stderr, "match: pattern %s: %s\n", p.name, err)
+			return 1
+		}
+	}
+
+	var out eventWriter
+	if *split != "" {
+		out, err = newSplitWriter(*split)
+		if err != nil {
+			fmt.Fprintf(stderr, "match: %s\n", err)
+			return 1
+		}
+	} else {
+		out = newStreamWriter(stdout, *all)
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	stats := newMatchStats()
+	status := 0
+	for _, file := range files {
+		if err := matchFile(m, file, stdin, out, *lenient, stats, stderr); err != nil {
+			fmt.Fprintf(stderr, "match: %s\n", err)
+			status = 1
+		}
+	}
+	if err := out.Close(); err != nil {
+		fmt.Fprintf(stderr, "match: %s\n", err)
+		status = 1
+	}
+
+	stats.write(stderr)
+	if stats.errors > 0 {
+		status = 1
+	}
+	return status
+}
+
+// namedPattern is a pattern and the name it's reported by.
+type namedPattern struct {
+	name    string
+	pattern string
+}
+
+// loadNamedPatterns loads patterns from a directory, where every *.json file holds the
+// patterns of the name of the file, or from a YAML file mapping names to patterns.
+//
+//	In YAML, a pattern is either written as YAML or as a JSON string, several patterns
+//	of a name are given as a list. Numbers written as YAML are re-encoded, so JSON
+//	strings should be used when their exact text matters.
+func loadNamedPatterns(from string) ([]namedPattern, error) {
+	info, err := os.Stat(from)
+	if err != nil {
+		return nil, fmt.Errorf("loadNamedPatterns: %s", err)
+	}
+	if !info.IsDir() {
+		return loadYAMLPatterns(from)
+	}
+
+	files, err := filepath.Glob(filepath.Join(from, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loadNamedPatterns: %s", err)
+	}
+
+	var patterns []namedPattern
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+
+		filePatterns, err := readPatterns(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, pattern := range filePatterns {
+			patterns = append(patterns, namedPattern{name: name, pattern: pattern})
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("loadNamedPatterns: no patterns in %s", from)
+	}
+
+	return patterns, nil
+}
+
+func loadYAMLPatterns(file string) ([]namedPattern, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("loadYAMLPatterns: %s", err)
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("loadYAMLPatterns: %s: %s", file, err)
+	}
+
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var patterns []namedPattern
+	for _, name := range names {
+		values, ok := doc[name].([]interface{})
+		if !ok {
+			values = []interface{}{doc[name]}
+		}
+
+		for _, v := range values {
+			pattern, err := yamlPattern(v)
+			if err != nil {
+				return nil, fmt.Errorf("loadYAMLPatterns: %s: pattern %s: %s", file, name, err)
+			}
+			patterns = append(patterns, namedPattern{name: name, pattern: pattern})
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("loadYAMLPatterns: no patterns in %s", file)
+	}
+
+	return patterns, nil
+}
+
+func yamlPattern(v interface{}) (string, error) {
+	switch p := v.(type) {
+	case string:
+		return p, nil
+	case map[string]interface{}:
+		b, err := json.Marshal(p)
+		return string(b), err
+	default:
+		return "", fmt.Errorf("must be an object or a JSON string, got %T", v)
+	}
+}
+
+// matchFile streams the NDJSON events of a file (or stdin) through the matcher. Lenient
+// events are written out normalized, so the output stays JSON.
+func matchFile(m *flattener.Matcher, file string, stdin io.Reader, out eventWriter, lenient bool, stats *matchStats, stderr io.Writer) error {
+	var r io.Reader = stdin
+	if file == "-" {
+		file = "stdin"
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("matchFile: %s", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("matchFile: %s: %s", file, err)
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	var normalized []byte
+	line := 0
+	for scanner.Scan() {
+		line++
+		event := bytes.TrimSpace(scanner.Bytes())
+		if len(event) == 0 {
+			continue
+		}
+
+		stats.events++
+		matches, err := m.MatchesForEvent(event)
+		if err != nil {
+			stats.errors++
+			fmt.Fprintf(stderr, "match: %s:%d: %s\n", file, line, err)
+			continue
+		}
+
+		if lenient {
+			if normalized, err = flattener.AppendNormalizedJSON(normalized[:0], event); err != nil {
+				stats.errors++
+				fmt.Fprintf(stderr, "match: %s:%d: %s\n", file, line, err)
+				continue
+			}
+			event = normalized
+		}
+
+		names := make([]string, len(matches))
+		for i, x := range matches {
+			names[i] = fmt.Sprint(x)
+		}
+		sort.Strings(names)
+		stats.add(names)
+
+		if err := out.Write(event, names); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("matchFile: %s: %s", file, err)
+	}
+
+	return nil
+}
+
+// eventWriter writes the events with the names of the patterns they matched.
+type eventWriter interface {
+	Write(event []byte, names []string) error
+	Close() error
+}
+
+// streamWriter writes events as JSON lines of {"matches": [...], "event": {...}}.
+type streamWriter struct {
+	w   *bufio.Writer
+	all bool
+}
+
+func newStreamWriter(w io.Writer, all bool) *streamWriter {
+	return &streamWriter{w: bufio.NewWriter(w), all: all}
+}
+
+func (s *streamWriter) Write(event []byte, names []string) error {
+	if len(names) == 0 && !s.all {
+		return nil
+	}
+
+	matches, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	s.w.WriteString(`{"matches":`)
+	s.w.Write(matches)
+	s.w.WriteString(`,"event":`)
+	s.w.Write(event)
+	_, err = s.w.WriteString("}\n")
+	return err
+}
+
+func (s *streamWriter) Close() error {
+	return s.w.Flush()
+}
+
+// splitWriter writes the events matching a pattern to <dir>/<name>.ndjson, the files
+// are created on the first match.
+type splitWriter struct {
+	dir   string
+	files map[string]*os.File
+	bufs  map[string]*bufio.Writer
+}
+
+func newSplitWriter(dir string) (*splitWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("newSplitWriter: %s", err)
+	}
+
+	return &splitWriter{dir: dir, files: make(map[string]*os.File), bufs: make(map[string]*bufio.Writer)}, nil
+}
+
+func (s *splitWriter) Write(event []byte, names []string) error {
+	for _, name := range names {
+		w, ok := s.bufs[name]
+		if !ok {
+			if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+				return fmt.Errorf("splitWriter: pattern name %q can't be a file name", name)
+			}
+
+			f, err := os.Create(filepath.Join(s.dir, name+".ndjson"))
+			if err != nil {
+				return fmt.Errorf("splitWriter: %s", err)
+			}
+			w = bufio.NewWriter(f)
+			s.files[name], s.bufs[name] = f, w
+		}
+
+		w.Write(event)
+		if err := w.WriteByte('\n'); err != nil {
+			return fmt.Errorf("splitWriter: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *splitWriter) Close() error {
+	var firstErr error
+	for name, f := range s.files {
+		if err := s.bufs[name].Flush(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("splitWriter: %s", err)
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("splitWriter: %s", err)
+		}
+	}
+	return firstErr
+}
+
+// matchStats are the counts reported on stderr once all events were matched.
+type matchStats struct {
+	start   time.Time
+	events  int
+	matched int
+	errors  int
+	counts  map[string]int
+}
+
+func newMatchStats() *matchStats {
+	return &matchStats{start: time.Now(), counts: make(map[string]int)}
+}
+
+func (s *matchStats) add(names []string) {
+	if len(names) > 0 {
+		s.matched++
+	}
+	for _, name := range names {
+		s.counts[name]++
+	}
+}
+
+func (s *matchStats) write(w io.Writer) {
+	elapsed := time.Since(s.start)
+	perSecond := float64(s.events) / elapsed.Seconds()
+
+	fmt.Fprintf(w, "%d events, %d matched, %d errors in %s (%.2f events/second)\n",
+		s.events, s.matched, s.errors, elapsed.Round(time.Millisecond), perSecond)
+
+	names := make([]string, 0, len(s.counts))
+	for name := range s.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s: %d\n", name, s.counts[name])
+	}
+}
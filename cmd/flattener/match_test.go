@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const matchEvents = `{"properties": {"STREET": "CRANLEIGH"}, "geometry": {"coordinates": [1, 2]}}
+{"properties": {"STREET": "BEACH"}, "geometry": {"coordinates": [3]}}
+
+{"properties": {"STREET": "BEACH"}, "geometry": {"coordinates": [2]}}
+`
+
+func Test_Match_YAMLPatterns(t *testing.T) {
+	patterns := writeFile(t, "patterns.yaml", []byte(`
+cranleigh:
+  properties:
+    STREET: [CRANLEIGH]
+two: '{"geometry": {"coordinates": [2]}}'
+starts-with-b:
+  - {"properties": {"STREET": [{"shellstyle": "B*"}]}}
+`))
+
+	status, stdout, stderr := runCommand(t, matchEvents, "match", "-patterns", patterns)
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, stderr)
+	}
+
+	wanted := `{"matches":["cranleigh","two"],"event":{"properties": {"STREET": "CRANLEIGH"}, "geometry": {"coordinates": [1, 2]}}}
+{"matches":["starts-with-b"],"event":{"properties": {"STREET": "BEACH"}, "geometry": {"coordinates": [3]}}}
+{"matches":["starts-with-b","two"],"event":{"properties": {"STREET": "BEACH"}, "geometry": {"coordinates": [2]}}}
+`
+	if stdout != wanted {
+		t.Errorf("wanted:\n%s\ngot:\n%s", wanted, stdout)
+	}
+
+	for _, s := range []string{"3 events, 3 matched, 0 errors", "  cranleigh: 1\n", "  starts-with-b: 2\n", "  two: 2\n"} {
+		if !strings.Contains(stderr, s) {
+			t.Errorf("stats missing %q: %s", s, stderr)
+		}
+	}
+}
+
+func Test_Match_SplitDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for name, pattern := range map[string]string{
+		"cranleigh.json": `{"properties": {"STREET": ["CRANLEIGH"]}}`,
+		"small.json":     `{"geometry": {"coordinates": [1]}} {"geometry": {"coordinates": [3]}}`,
+		"ignored.txt":    `{"geometry": {"coordinates": [2]}}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(pattern), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(matchEvents))
+	_ = zw.Close()
+	events := writeFile(t, "events.ndjson.gz", gz.Bytes())
+
+	out := filepath.Join(t.TempDir(), "out")
+	status, stdout, stderr := runCommand(t, "", "match", "-patterns", dir, "-split", out, events)
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("wanted nothing on stdout when splitting, got %s", stdout)
+	}
+
+	lines := strings.Split(matchEvents, "\n")
+	for name, wanted := range map[string]string{
+		"cranleigh.ndjson": lines[0] + "\n",
+		"small.ndjson":     lines[0] + "\n" + lines[1] + "\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != wanted {
+			t.Errorf("%s: wanted:\n%s\ngot:\n%s", name, wanted, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "ignored.ndjson")); err == nil {
+		t.Error("wanted only .json files to be loaded as patterns")
+	}
+}
+
+func Test_Match_All(t *testing.T) {
+	patterns := writeFile(t, "patterns.yaml", []byte(`cranleigh: '{"properties": {"STREET": ["CRANLEIGH"]}}'`))
+
+	status, stdout, stderr := runCommand(t, matchEvents, "match", "-patterns", patterns, "-all")
+	if status != 0 {
+		t.Fatalf("status %d: %s", status, stderr)
+	}
+	if got := strings.Count(stdout, `{"matches":[],`); got != 2 {
+		t.Errorf("wanted 2 events without matches, got %d: %s", got, stdout)
+	}
+}
+
+func Test_Match_LenientWritesJSON(t *testing.T) {
+	patterns := writeFile(t, "patterns.yaml", []byte(`a: '{"a": [1]}'`))
+	events := "{\"a\": 1, /* one */ 'b': 'x',}\n"
+
+	for _, args := range [][]string{
+		{"match", "-patterns", patterns, "-lenient"},
+		{"match", "-patterns", patterns, "-lenient", "-split", filepath.Join(t.TempDir(), "out")},
+	} {
+		status, stdout, stderr := runCommand(t, events, args...)
+		if status != 0 {
+			t.Fatalf("%q: status %d: %s", args, status, stderr)
+		}
+
+		out := []byte(stdout)
+		if len(args) > 4 {
+			var err error
+			if out, err = os.ReadFile(filepath.Join(args[5], "a.ndjson")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !json.Valid(bytes.TrimSpace(out)) {
+			t.Errorf("%q: wanted a JSON line, got %s", args, out)
+		}
+		if !strings.Contains(string(out), `"b": "x"`) {
+			t.Errorf("%q: wanted the normalized event, got %s", args, out)
+		}
+	}
+}
+
+func Test_Match_Errors(t *testing.T) {
+	bad := writeFile(t, "bad.yaml", []byte(`bad: 1`))
+	invalid := writeFile(t, "invalid.yaml", []byte(`bad: '{"a": 1}'`))
+	good := writeFile(t, "good.yaml", []byte(`good: '{"a": [1]}'`))
+
+	for _, c := range []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"match"}, 2},
+		{[]string{"match", "-patterns", "missing.yaml"}, 1},
+		{[]string{"match", "-patterns", bad}, 1},
+		{[]string{"match", "-patterns", invalid}, 1},
+		{[]string{"match", "-patterns", t.TempDir()}, 1},
+		{[]string{"match", "-patterns", good, "missing.ndjson"}, 1},
+		{[]string{"match", "-patterns", good, "-split", t.TempDir(), "-all"}, 2},
+	} {
+		if status, _, _ := runCommand(t, "", c.args...); status != c.status {
+			t.Errorf("%q: wanted status %d got %d", c.args, c.status, status)
+		}
+	}
+
+	// Events which fail are reported, the rest are still matched.
+	status, stdout, stderr := runCommand(t, "[1]\n{\"a\": 1}\n", "match", "-patterns", good)
+	if status != 1 || !strings.Contains(stderr, "stdin:1") || !strings.Contains(stdout, `"good"`) {
+		t.Errorf("wanted the first event to fail, got %d: %s%s", status, stdout, stderr)
+	}
+}
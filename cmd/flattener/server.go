@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	flattener "github.com/yosiat/quamina-flatenner"
+)
+
+// maxPatternsSize limits the body of a PUT /patterns/{name}.
+const maxPatternsSize = 1024 * 1024
+
+func runServe(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	addr := fs.String("addr", ":8080", "address to listen on")
+	patternsFrom := fs.String("patterns", "", "directory of pattern files or a YAML file of named patterns to load")
+	reload := fs.Duration("reload", 5*time.Second, "how often to check the patterns for changes, 0 disables reloading")
+	lenient := fs.Bool("lenient", false, "accept JSONC / JSON5-like events")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := log.New(stderr, "", log.LstdFlags)
+
+	var opts []flattener.Option
+	if *lenient {
+		opts = append(opts, flattener.WithLenientJSON())
+	}
+	s, err := newServer(logger, opts...)
+	if err != nil {
+		logger.Printf("serve: %s", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *patternsFrom != "" {
+		if err := s.loadPatterns(*patternsFrom); err != nil {
+			logger.Printf("serve: %s", err)
+			return 1
+		}
+		if *reload > 0 {
+			go s.watchPatterns(ctx, *reload)
+		}
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Printf("listening on %s", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Printf("serve: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// server matches events over HTTP:
+//
+//	POST   /match            matches an event, or an NDJSON batch (Content-Type: application/x-ndjson)
+//	GET    /patterns         lists the patterns by name
+//	GET    /patterns/{name}  returns the patterns of a name
+//	PUT    /patterns/{name}  replaces the patterns of a name, the body is one or more patterns
+//	DELETE /patterns/{name}  deletes the patterns of a name
+//	GET    /metrics          flattening metrics, in the Prometheus text format
+//
+//	The Matcher keeps the PathIndex in sync with the patterns, every request matches with
+//	its own copy of it. Requests changing the patterns wait for the running matches, so a
+//	replaced pattern is never missing for a match.
+type server struct {
+	mu sync.RWMutex
+	m  *flattener.Matcher
+
+	// patterns are the patterns of every name, fromFile are the names loaded from
+	// patternsFrom (the ones a reload is allowed to delete).
+	patterns map[string][]string
+	fromFile map[string]bool
+
+	patternsFrom string
+	signature    string
+
+	matchers sync.Pool
+	metrics  *flattener.PrometheusMetrics
+	logger   *log.Logger
+}
+
+func newServer(logger *log.Logger, opts ...flattener.Option) (*server, error) {
+	metrics := flattener.NewPrometheusMetrics("flattener")
+
+	m, err := flattener.NewMatcher(append(opts, flattener.WithMetrics(metrics))...)
+	if err != nil {
+		return nil, fmt.Errorf("newServer: %s", err)
+	}
+
+	s := &server{
+		m:        m,
+		patterns: make(map[string][]string),
+		fromFile: make(map[string]bool),
+		metrics:  metrics,
+		logger:   logger,
+	}
+	s.matchers.New = func() interface{} { return s.m.Copy() }
+
+	return s, nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/match":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		s.handleMatch(w, r)
+	case r.URL.Path == "/patterns":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.handleListPatterns(w)
+	case r.URL.Path == "/metrics":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.metrics.ServeHTTP(w, r)
+	case strings.HasPrefix(r.URL.Path, "/patterns/"):
+		name := strings.TrimPrefix(r.URL.Path, "/patterns/")
+		if name == "" || strings.Contains(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		s.handlePattern(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) handleMatch(w http.ResponseWriter, r *http.Request) {
+	m := s.matchers.Get().(*flattener.Matcher)
+	defer s.matchers.Put(m)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		s.matchBatch(w, r, m)
+		return
+	}
+
+	event, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	names, err := s.match(m, event)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, matchResult{Matches: names})
+}
+
+// matchResult is the response of a match, in a batch every event gets either
+// matches or an error.
+type matchResult struct {
+	Matches []string `json:"matches"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// matchBatch matches NDJSON events, writing a result line for every event (empty
+// lines are skipped).
+func (s *server) matchBatch(w http.ResponseWriter, r *http.Request, m *flattener.Matcher) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	enc := json.NewEncoder(w)
+	for scanner.Scan() {
+		event := bytes.TrimSpace(scanner.Bytes())
+		if len(event) == 0 {
+			continue
+		}
+
+		var res matchResult
+		names, err := s.match(m, event)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Matches = names
+		}
+
+		if err := enc.Encode(res); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = enc.Encode(matchResult{Error: err.Error()})
+	}
+}
+
+func (s *server) match(m *flattener.Matcher, event []byte) ([]string, error) {
+	s.mu.RLock()
+	matches, err := m.MatchesForEvent(event)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(matches))
+	for i, x := range matches {
+		names[i] = fmt.Sprint(x)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *server) handleListPatterns(w http.ResponseWriter) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string][]json.RawMessage, len(s.patterns))
+	for name, patterns := range s.patterns {
+		all[name] = rawPatterns(patterns)
+	}
+	writeJSON(w, http.StatusOK, all)
+}
+
+func (s *server) handlePattern(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.RLock()
+		patterns, ok := s.patterns[name]
+		s.mu.RUnlock()
+
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no patterns named %q", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, rawPatterns(patterns))
+	case http.MethodPut:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatternsSize))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+
+		patterns, err := splitPatterns(body)
+		if err == nil && len(patterns) == 0 {
+			err = fmt.Errorf("no patterns in the body")
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s.mu.Lock()
+		err = s.replacePatterns(name, patterns)
+		delete(s.fromFile, name)
+		s.mu.Unlock()
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		s.mu.Lock()
+		_, ok := s.patterns[name]
+		var err error
+		if ok {
+			err = s.deletePatterns(name)
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no patterns named %q", name))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// replacePatterns replaces the patterns of a name, when one of them fails the previous
+// patterns are restored. Called with s.mu held.
+func (s *server) replacePatterns(name string, patterns []string) error {
+	if err := s.m.DeletePattern(name); err != nil {
+		return err
+	}
+
+	for _, pattern := range patterns {
+		if err := s.m.AddPattern(name, pattern); err != nil {
+			_ = s.m.DeletePattern(name)
+			for _, old := range s.patterns[name] {
+				_ = s.m.AddPattern(name, old)
+			}
+			return err
+		}
+	}
+
+	s.patterns[name] = patterns
+	return nil
+}
+
+// deletePatterns deletes the patterns of a name. Called with s.mu held.
+func (s *server) deletePatterns(name string) error {
+	if err := s.m.DeletePattern(name); err != nil {
+		return err
+	}
+
+	delete(s.patterns, name)
+	delete(s.fromFile, name)
+	return nil
+}
+
+// loadPatterns loads the named patterns of a directory or YAML file (see
+// loadNamedPatterns), replacing the ones loaded before. Names which were loaded before
+// and are gone are deleted, names set through PUT are kept unless the file has them.
+func (s *server) loadPatterns(from string) error {
+	signature, err := patternsSignature(from)
+	if err != nil {
+		return err
+	}
+	loaded, err := loadNamedPatterns(from)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string][]string)
+	for _, p := range loaded {
+		byName[p.name] = append(byName[p.name], p.pattern)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range s.fromFile {
+		if _, ok := byName[name]; !ok {
+			if err := s.deletePatterns(name); err != nil {
+				return fmt.Errorf("loadPatterns: %s: %s", name, err)
+			}
+		}
+	}
+
+	for name, patterns := range byName {
+		if !equalPatterns(s.patterns[name], patterns) {
+			if err := s.replacePatterns(name, patterns); err != nil {
+				return fmt.Errorf("loadPatterns: %s: %s", name, err)
+			}
+		}
+		s.fromFile[name] = true
+	}
+
+	s.patternsFrom, s.signature = from, signature
+	return nil
+}
+
+// watchPatterns reloads the patterns when their files change, until ctx is done.
+func (s *server) watchPatterns(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.reloadPatterns(); err != nil {
+				s.logger.Printf("reloading patterns: %s", err)
+			}
+		}
+	}
+}
+
+// reloadPatterns reloads the patterns if their files changed since they were loaded,
+// returning whether they did. Failed reloads keep the patterns which were loaded.
+func (s *server) reloadPatterns() (bool, error) {
+	s.mu.RLock()
+	from, signature := s.patternsFrom, s.signature
+	s.mu.RUnlock()
+
+	current, err := patternsSignature(from)
+	if err != nil {
+		return false, err
+	}
+	if current == signature {
+		return false, nil
+	}
+
+	if err := s.loadPatterns(from); err != nil {
+		// Don't retry until the files change again.
+		s.mu.Lock()
+		s.signature = current
+		s.mu.Unlock()
+		return false, err
+	}
+
+	s.logger.Printf("reloaded patterns from %s", from)
+	return true, nil
+}
+
+// patternsSignature changes whenever the pattern files are modified.
+func patternsSignature(from string) (string, error) {
+	info, err := os.Stat(from)
+	if err != nil {
+		return "", fmt.Errorf("patternsSignature: %s", err)
+	}
+	if !info.IsDir() {
+		return fileSignature(info), nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(from, "*.json"))
+	if err != nil {
+		return "", fmt.Errorf("patternsSignature: %s", err)
+	}
+
+	var sig strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", fmt.Errorf("patternsSignature: %s", err)
+		}
+		fmt.Fprintf(&sig, "%s %s\n", filepath.Base(file), fileSignature(info))
+	}
+	return sig.String(), nil
+}
+
+func fileSignature(info os.FileInfo) string {
+	return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+}
+
+func equalPatterns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func rawPatterns(patterns []string) []json.RawMessage {
+	raw := make([]json.RawMessage, len(patterns))
+	for i, pattern := range patterns {
+		raw[i] = json.RawMessage(pattern)
+	}
+	return raw
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, matchResult{Error: err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*server, *httptest.Server) {
+	t.Helper()
+
+	s, err := newServer(log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func request(t *testing.T, ts *httptest.Server, method, path, contentType, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func Test_Server_Patterns(t *testing.T) {
+	_, ts := newTestServer(t)
+	event := `{"properties": {"STREET": "CRANLEIGH"}, "geometry": {"coordinates": [1, 2]}}`
+
+	for _, step := range []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{"POST", "/match", event, 200, `{"matches":[]}`},
+		{"PUT", "/patterns/street", `{"properties": {"STREET": ["CRANLEIGH"]}}`, 204, ``},
+		{"PUT", "/patterns/coordinates", `{"geometry": {"coordinates": [1]}} {"geometry": {"coordinates": [9]}}`, 204, ``},
+		{"POST", "/match", event, 200, `{"matches":["coordinates","street"]}`},
+		{"GET", "/patterns/coordinates", ``, 200, `[{"geometry":{"coordinates":[1]}},{"geometry":{"coordinates":[9]}}]`},
+
+		// Replacing the patterns of a name drops the previous ones.
+		{"PUT", "/patterns/coordinates", `{"geometry": {"coordinates": [9]}}`, 204, ``},
+		{"POST", "/match", event, 200, `{"matches":["street"]}`},
+
+		// A failed replace keeps the previous patterns.
+		{"PUT", "/patterns/street", `{"properties": {"STREET": "CRANLEIGH"}}`, 400, ``},
+		{"PUT", "/patterns/street", ``, 400, ``},
+		{"POST", "/match", event, 200, `{"matches":["street"]}`},
+
+		{"DELETE", "/patterns/street", ``, 204, ``},
+		{"DELETE", "/patterns/street", ``, 404, ``},
+		{"GET", "/patterns/street", ``, 404, ``},
+		{"POST", "/match", event, 200, `{"matches":[]}`},
+		{"GET", "/patterns", ``, 200, `{"coordinates":[{"geometry":{"coordinates":[9]}}]}`},
+
+		// Patterns put under a deleted name don't bring back the deleted ones.
+		{"PUT", "/patterns/street", `{"properties": {"STREET": ["BEACH"]}}`, 204, ``},
+		{"POST", "/match", event, 200, `{"matches":[]}`},
+		{"POST", "/match", `{"properties": {"STREET": "BEACH"}}`, 200, `{"matches":["street"]}`},
+
+		{"POST", "/match", `[1]`, 400, ``},
+		{"GET", "/match", ``, 405, ``},
+		{"POST", "/patterns/a/b", ``, 404, ``},
+		{"GET", "/other", ``, 404, ``},
+	} {
+		status, response := request(t, ts, step.method, step.path, "", step.body)
+		if status != step.status {
+			t.Errorf("%s %s: wanted status %d got %d: %s", step.method, step.path, step.status, status, response)
+		}
+		if step.response != "" && strings.TrimSpace(response) != step.response {
+			t.Errorf("%s %s: wanted %s got %s", step.method, step.path, step.response, response)
+		}
+	}
+}
+
+func Test_Server_MatchBatch(t *testing.T) {
+	_, ts := newTestServer(t)
+	if status, response := request(t, ts, "PUT", "/patterns/beach", "", `{"properties": {"STREET": ["BEACH"]}}`); status != 204 {
+		t.Fatalf("PUT: %d %s", status, response)
+	}
+
+	batch := `{"properties": {"STREET": "BEACH"}}
+
+{"properties": {"STREET": "CRANLEIGH"}}
+[1]
+`
+	status, response := request(t, ts, "POST", "/match", "application/x-ndjson", batch)
+	if status != 200 {
+		t.Fatalf("wanted status 200 got %d: %s", status, response)
+	}
+
+	lines := strings.Split(strings.TrimSpace(response), "\n")
+	if len(lines) != 3 || lines[0] != `{"matches":["beach"]}` || lines[1] != `{"matches":[]}` || !strings.Contains(lines[2], `"error"`) {
+		t.Errorf("unexpected batch response:\n%s", response)
+	}
+
+	_, metrics := request(t, ts, "GET", "/metrics", "", "")
+	for _, line := range []string{"flattener_events_total 3\n", `flattener_errors_total{kind="syntax"} 1` + "\n"} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("missing %q in metrics:\n%s", line, metrics)
+		}
+	}
+}
+
+func Test_Server_ConcurrentMatches(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if status, response := request(t, ts, "POST", "/match", "", `{"a": 1, "b": 2}`); status != 200 {
+					t.Errorf("wanted status 200 got %d: %s", status, response)
+				}
+			}
+		}()
+	}
+	for _, name := range []string{"a", "b", "a"} {
+		if status, response := request(t, ts, "PUT", "/patterns/"+name, "", `{"`+name+`": [1, 2]}`); status != 204 {
+			t.Errorf("PUT: %d %s", status, response)
+		}
+	}
+	wg.Wait()
+
+	if _, response := request(t, ts, "POST", "/match", "", `{"a": 1, "b": 2}`); strings.TrimSpace(response) != `{"matches":["a","b"]}` {
+		t.Errorf("wanted both patterns to match, got %s", response)
+	}
+}
+
+func Test_Server_ReloadPatterns(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	dir := t.TempDir()
+	writePattern := func(name, pattern string, mtime time.Time) {
+		file := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(file, []byte(pattern), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// The mtime is set explicitly, so a rewrite in the same instant is noticed.
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	match := func() string {
+		_, response := request(t, ts, "POST", "/match", "", `{"a": 1, "b": 2, "c": 3}`)
+		return strings.TrimSpace(response)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	writePattern("a", `{"a": [1]}`, start)
+	writePattern("b", `{"b": [2]}`, start)
+	if err := s.loadPatterns(dir); err != nil {
+		t.Fatal(err)
+	}
+	if status, response := request(t, ts, "PUT", "/patterns/c", "", `{"c": [3]}`); status != 204 {
+		t.Fatalf("PUT: %d %s", status, response)
+	}
+	if got, wanted := match(), `{"matches":["a","b","c"]}`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	if changed, err := s.reloadPatterns(); changed || err != nil {
+		t.Errorf("wanted no reload without changes, got %v %v", changed, err)
+	}
+
+	// b changes and a is removed, the pattern set through PUT stays.
+	writePattern("b", `{"b": [5]}`, start.Add(time.Minute))
+	if err := os.Remove(filepath.Join(dir, "a.json")); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := s.reloadPatterns(); !changed || err != nil {
+		t.Fatalf("wanted a reload, got %v %v", changed, err)
+	}
+	if got, wanted := match(), `{"matches":["c"]}`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	// An invalid file keeps the loaded patterns.
+	writePattern("b", `{"b": 2}`, start.Add(2*time.Minute))
+	if _, err := s.reloadPatterns(); err == nil {
+		t.Error("wanted error for an invalid pattern")
+	}
+	if _, response := request(t, ts, "GET", "/patterns/b", "", ""); strings.TrimSpace(response) != `[{"b":[5]}]` {
+		t.Errorf("wanted the previous patterns of b, got %s", response)
+	}
+}
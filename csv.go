@@ -0,0 +1,230 @@
+package flattener
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/timbray/quamina"
+)
+
+// csvSampleRows is the number of rows ReadCSV looks at to infer the type of columns.
+const csvSampleRows = 100
+
+// CSVColumnType is the type values of a CSV column are converted to.
+type CSVColumnType int
+
+const (
+	// CSVAuto infers the type of every value on its own.
+	CSVAuto CSVColumnType = iota
+	CSVString
+	CSVNumber
+	CSVBool
+)
+
+type csvColumn struct {
+	path []byte
+	typ  CSVColumnType
+}
+
+// CSVFlattener flattens CSV (or TSV) rows, every row is an event.
+//
+//	Columns are mapped to paths by the header row, dots in a column name nest it,
+//	so "address.city" is matched by {"address": {"city": [...]}}. Columns which are
+//	not in the PathIndex are never converted.
+type CSVFlattener struct {
+	paths  PathIndex
+	header []string
+	comma  rune
+
+	// columns holds the indexed columns by their position in the row, nil for the rest.
+	columns []*csvColumn
+
+	fields []quamina.Field
+	buf    []byte
+}
+
+// NewCSVFlattener creates a flattener for rows with the given header, types can declare
+// the type of columns by their name, other columns are CSVAuto.
+func NewCSVFlattener(paths PathIndex, header []string, comma rune, types map[string]CSVColumnType) *CSVFlattener {
+	fc := &CSVFlattener{
+		paths:   paths,
+		header:  header,
+		comma:   comma,
+		columns: make([]*csvColumn, len(header)),
+		fields:  make([]quamina.Field, 0),
+	}
+
+	for i, name := range header {
+		path, ok := lookupField(paths, strings.Split(name, "."))
+		if !ok {
+			continue
+		}
+		fc.columns[i] = &csvColumn{path: path, typ: types[name]}
+	}
+
+	return fc
+}
+
+func (fc *CSVFlattener) Copy() quamina.Flattener {
+	types := make(map[string]CSVColumnType)
+	for i, c := range fc.columns {
+		if c != nil {
+			types[fc.header[i]] = c.typ
+		}
+	}
+	return NewCSVFlattener(fc.paths, fc.header, fc.comma, types)
+}
+
+func (fc *CSVFlattener) reset() {
+	fc.fields = fc.fields[:0]
+	fc.buf = fc.buf[:0]
+}
+
+// Flatten flattens a single row.
+func (fc *CSVFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	r := csv.NewReader(bytes.NewReader(event))
+	r.Comma = fc.comma
+	r.FieldsPerRecord = -1
+
+	record, err := r.Read()
+	if err != nil {
+		fc.reset()
+		return fc.fields, fmt.Errorf("csv: reading row: %s", err)
+	}
+
+	return fc.flattenRecord(record), nil
+}
+
+func (fc *CSVFlattener) flattenRecord(record []string) []quamina.Field {
+	fc.reset()
+
+	for i, value := range record {
+		if i >= len(fc.columns) || fc.columns[i] == nil {
+			continue
+		}
+		c := fc.columns[i]
+
+		start := len(fc.buf)
+		fc.buf = appendCSVValue(fc.buf, value, c.typ)
+		fc.fields = append(fc.fields, quamina.Field{Path: c.path, Val: fc.buf[start:len(fc.buf):len(fc.buf)]})
+	}
+
+	return fc.fields
+}
+
+// appendCSVValue appends the JSON form of a value, values which don't fit the type of
+// their column are kept as strings. So an empty cell is always "", whatever the type of
+// its column.
+func appendCSVValue(dst []byte, value string, typ CSVColumnType) []byte {
+	switch typ {
+	case CSVAuto:
+		return appendCSVValue(dst, value, inferCSVType(value))
+	case CSVNumber:
+		if isJSONNumber(value) {
+			return append(dst, value...)
+		}
+	case CSVBool:
+		if value == "true" || value == "false" {
+			return append(dst, value...)
+		}
+	}
+
+	return appendJSONString(dst, value, false)
+}
+
+func inferCSVType(value string) CSVColumnType {
+	switch {
+	case value == "true" || value == "false":
+		return CSVBool
+	case isJSONNumber(value):
+		return CSVNumber
+	}
+	return CSVString
+}
+
+// inferCSVColumnTypes infers the type of every column from sample rows, a column is a
+// number or a bool only if all its non-empty values are.
+func inferCSVColumnTypes(header []string, rows [][]string) map[string]CSVColumnType {
+	types := make(map[string]CSVColumnType, len(header))
+
+	for i, name := range header {
+		typ := CSVAuto
+		for _, row := range rows {
+			if i >= len(row) || row[i] == "" {
+				continue
+			}
+
+			valueTyp := inferCSVType(row[i])
+			if typ == CSVAuto {
+				typ = valueTyp
+			} else if typ != valueTyp {
+				typ = CSVString
+				break
+			}
+		}
+
+		if typ == CSVAuto {
+			typ = CSVString
+		}
+		types[name] = typ
+	}
+
+	return types
+}
+
+// ReadCSV reads a CSV stream starting with a header row and calls fn with the fields
+// of every row (row numbers start at 1, after the header).
+//
+//	Column types are inferred from the first csvSampleRows rows.
+func ReadCSV(in io.Reader, paths PathIndex, comma rune, fn func(row int, fields []quamina.Field) error) error {
+	r := csv.NewReader(in)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("csv: reading header: %s", err)
+	}
+
+	sample := make([][]string, 0, csvSampleRows)
+	for len(sample) < csvSampleRows {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("csv: reading row %d: %s", len(sample)+1, err)
+		}
+		sample = append(sample, record)
+	}
+
+	fc := NewCSVFlattener(paths, header, comma, inferCSVColumnTypes(header, sample))
+
+	row := 0
+	for _, record := range sample {
+		row++
+		if err := fn(row, fc.flattenRecord(record)); err != nil {
+			return err
+		}
+	}
+
+	r.ReuseRecord = true
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		row++
+		if err != nil {
+			return fmt.Errorf("csv: reading row %d: %s", row, err)
+		}
+
+		if err := fn(row, fc.flattenRecord(record)); err != nil {
+			return err
+		}
+	}
+}
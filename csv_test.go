@@ -0,0 +1,127 @@
+package flattener
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+func Test_CSV_Flatten(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range []string{"id", "address\ncity", "active", "score"} {
+		paths.Add(path)
+	}
+
+	header := []string{"id", "name", "address.city", "active", "score"}
+	fc := NewCSVFlattener(paths, header, ',', map[string]CSVColumnType{"id": CSVString})
+
+	fields, err := fc.Flatten([]byte(`0042,"Doe, John","Tel ""Aviv""",true,7.5`+"\n"), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := []quamina.Field{
+		{Path: []byte("id"), Val: []byte(`"0042"`)},
+		{Path: []byte("address\ncity"), Val: []byte(`"Tel \"Aviv\""`)},
+		{Path: []byte("active"), Val: []byte(`true`)},
+		{Path: []byte("score"), Val: []byte(`7.5`)},
+	}
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+}
+
+func Test_CSV_EmptyCells(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range []string{"n", "b", "s", "a"} {
+		paths.Add(path)
+	}
+
+	types := map[string]CSVColumnType{"n": CSVNumber, "b": CSVBool, "s": CSVString}
+	fc := NewCSVFlattener(paths, []string{"n", "b", "s", "a"}, ',', types)
+
+	fields, err := fc.Flatten([]byte(",,,\n"), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	// An empty cell is "" whatever the type of its column.
+	wanted := `["a"="" []]["b"="" []]["n"="" []]["s"="" []]`
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
+
+func Test_CSV_ReadStream(t *testing.T) {
+	tsv := "id\tzip\tcity\n" +
+		"1\t01234\tHaifa\n" +
+		"2\t\tEilat\n" +
+		"3\t98000\tAcre\n"
+
+	paths := NewPaths()
+	paths.Add("zip")
+	paths.Add("city")
+
+	var got []string
+	err := ReadCSV(strings.NewReader(tsv), paths, '\t', func(row int, fields []quamina.Field) error {
+		got = append(got, fieldsSet(fields))
+		return nil
+	})
+	if err != nil {
+		t.Fatal("ReadCSV: " + err.Error())
+	}
+
+	// "01234" isn't a JSON number, so the zip column is inferred as a string column.
+	wanted := []string{
+		`["city"="Haifa" []]["zip"="01234" []]`,
+		`["city"="Eilat" []]["zip"="" []]`,
+		`["city"="Acre" []]["zip"="98000" []]`,
+	}
+	if len(got) != len(wanted) {
+		t.Fatalf("wanted %d rows, got %d", len(wanted), len(got))
+	}
+	for i := range wanted {
+		if got[i] != wanted[i] {
+			t.Errorf("row %d: wanted %s got %s", i+1, wanted[i], got[i])
+		}
+	}
+}
+
+func Test_CSV_InferColumnTypes(t *testing.T) {
+	header := []string{"n", "b", "mixed", "empty"}
+	rows := [][]string{
+		{"1", "true", "1", ""},
+		{"-2.5e3", "", "yes", ""},
+		{"", "false", "3", ""},
+	}
+
+	types := inferCSVColumnTypes(header, rows)
+	wanted := map[string]CSVColumnType{"n": CSVNumber, "b": CSVBool, "mixed": CSVString, "empty": CSVString}
+	for name, typ := range wanted {
+		if types[name] != typ {
+			t.Errorf("column %s: wanted %d got %d", name, typ, types[name])
+		}
+	}
+}
+
+func Test_CSV_Matching(t *testing.T) {
+	pattern := `{"address": {"city": ["Haifa"]}, "active": [true]}`
+	paths := NewPaths()
+	if err := paths.AddPattern(pattern); err != nil {
+		t.Fatal("addPattern: " + err.Error())
+	}
+
+	m := newCustomCoreMatcher(NewCSVFlattener(paths, []string{"address.city", "active"}, ',', nil))
+	if err := m.AddPattern("haifa", pattern); err != nil {
+		t.Fatal("AddPattern: " + err.Error())
+	}
+
+	matches, err := m.MatchesForEvent([]byte("Haifa,true"))
+	if err != nil {
+		t.Fatal("MatchesForEvent: " + err.Error())
+	}
+	if len(matches) != 1 || matches[0] != quamina.X("haifa") {
+		t.Errorf("wanted haifa, got %v", matches)
+	}
+}
@@ -0,0 +1,128 @@
+package flattener
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/go-faster/jx"
+)
+
+// parseEmbeddedJSON handles a string value holding a JSON document, the string is
+// unescaped and the document is traversed as the value of the node.
+//
+//	When the key is also a field by itself, the string is emitted as is as well.
+func (fj *JxFlattener) parseEmbeddedJSON(n Node, path []byte, isField bool) error {
+	raw, err := fj.getPrimitiveValue()
+	if err != nil {
+		return err
+	}
+
+	if isField {
+		if err := fj.storeField(path, raw); err != nil {
+			return err
+		}
+	}
+
+	dcd := jx.GetDecoder()
+	defer jx.PutDecoder(dcd)
+	dcd.ResetBytes(raw)
+
+	start := len(fj.values)
+	fj.values, err = dcd.StrAppend(fj.values)
+	if err != nil {
+		return fmt.Errorf("parseEmbeddedJSON: failed unescaping: %s", err)
+	}
+
+	return fj.traverseEmbeddedJSON(n, fj.values[start:len(fj.values):len(fj.values)])
+}
+
+// traverseEmbeddedJSON decodes an embedded document and traverses it, documents which
+// aren't objects have nothing to match and are ignored.
+func (fj *JxFlattener) traverseEmbeddedJSON(n Node, doc []byte) error {
+	doc, err := fj.decodeEmbedded(n.getSettings(), doc)
+	if err != nil {
+		fj.stats.errorKind = ErrorKindEmbedded
+		return err
+	}
+
+	return fj.traverseRaw(doc, func() error {
+		if fj.tok.Next() != jx.Object {
+			return nil
+		}
+		return fj.traverseNode(n)
+	})
+}
+
+// decodeEmbedded applies the decode steps of a node on its value, the output of every
+// step is appended to fj.values.
+func (fj *JxFlattener) decodeEmbedded(settings *nodeSettings, doc []byte) ([]byte, error) {
+	for _, step := range settings.decodeSteps {
+		start := len(fj.values)
+
+		var err error
+		switch step {
+		case DecodeBase64:
+			fj.values, err = appendBase64Decoded(fj.values, doc, settings.maxDecodedSize)
+		case DecodeGzip:
+			fj.values, err = fj.appendGunzipped(fj.values, doc, settings.maxDecodedSize)
+		default:
+			err = fmt.Errorf("unknown decode step %d", step)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decodeEmbedded: %s", err)
+		}
+
+		doc = fj.values[start:len(fj.values):len(fj.values)]
+	}
+
+	return doc, nil
+}
+
+func appendBase64Decoded(dst []byte, src []byte, limit int) ([]byte, error) {
+	enc := base64.StdEncoding
+	if len(src)%4 != 0 {
+		enc = base64.RawStdEncoding
+	}
+
+	size := enc.DecodedLen(len(src))
+	if size > limit {
+		return dst, fmt.Errorf("base64 value decodes to more than %d bytes", limit)
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, size)...)
+	n, err := enc.Decode(dst[start:], src)
+	if err != nil {
+		return dst[:start], fmt.Errorf("invalid base64: %s", err)
+	}
+
+	return dst[:start+n], nil
+}
+
+// appendGunzipped decompresses src, reading at most limit bytes so a small value
+// can't expand into gigabytes (a zip bomb).
+func (fj *JxFlattener) appendGunzipped(dst []byte, src []byte, limit int) ([]byte, error) {
+	var err error
+	if fj.gzip == nil {
+		fj.gzip, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = fj.gzip.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return dst, fmt.Errorf("invalid gzip: %s", err)
+	}
+
+	buf := bytes.NewBuffer(dst)
+	n, err := io.Copy(buf, io.LimitReader(fj.gzip, int64(limit)+1))
+	if err != nil {
+		return dst, fmt.Errorf("invalid gzip: %s", err)
+	}
+	if n > int64(limit) {
+		return dst, fmt.Errorf("gzip value decompresses to more than %d bytes", limit)
+	}
+
+	return buf.Bytes(), nil
+}
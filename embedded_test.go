@@ -0,0 +1,178 @@
+package flattener
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+const snsNotification = `{
+  "Type": "Notification",
+  "MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+  "Message": "{\"orderId\":\"o-17\",\"customer\":{\"tier\":\"gold\"},\"items\":[\"a\",\"b\"],\"note\":\"say \\\"hi\\\"\"}",
+  "Timestamp": "2022-08-01T10:00:00.000Z"
+}`
+
+func Test_Embedded_SNSMessage(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range []string{"Type", "Message\norderId", "Message\ncustomer\ntier", "Message\nitems", "Message\nnote", "Timestamp"} {
+		paths.Add(path)
+	}
+	paths.AddEmbeddedJSON("Message")
+
+	fields, err := NewJxFlattener(paths).Flatten([]byte(snsNotification), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := []quamina.Field{
+		{Path: []byte("Type"), Val: []byte(`"Notification"`)},
+		{Path: []byte("Message\norderId"), Val: []byte(`"o-17"`)},
+		{Path: []byte("Message\ncustomer\ntier"), Val: []byte(`"gold"`)},
+		{Path: []byte("Message\nitems"), Val: []byte(`"a"`), ArrayTrail: []quamina.ArrayPos{{Array: 1, Pos: 1}}},
+		{Path: []byte("Message\nitems"), Val: []byte(`"b"`), ArrayTrail: []quamina.ArrayPos{{Array: 1, Pos: 2}}},
+		{Path: []byte("Message\nnote"), Val: []byte(`"say \"hi\""`)},
+		{Path: []byte("Timestamp"), Val: []byte(`"2022-08-01T10:00:00.000Z"`)},
+	}
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+}
+
+func Test_Embedded_NotMarked(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("Message\norderId")
+	paths.Add("Type")
+
+	fields, err := NewJxFlattener(paths).Flatten([]byte(snsNotification), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	// Without marking the node, the string is just skipped.
+	wanted := `["Type"="Notification" []]`
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
+
+func Test_Embedded_Nested(t *testing.T) {
+	inner, _ := json.Marshal(map[string]string{"detail": `{"state":"running"}`})
+	event, _ := json.Marshal(map[string]interface{}{"Message": string(inner), "raw": "not json", "Other": 1})
+
+	paths := NewPaths()
+	paths.Add("Message\ndetail\nstate")
+	paths.Add("raw\nx")
+	paths.Add("Other")
+	paths.AddEmbeddedJSON("Message")
+	paths.AddEmbeddedJSON("Message\ndetail")
+	paths.AddEmbeddedJSON("raw")
+
+	fj := NewJxFlattener(paths)
+	fields, err := fj.Flatten(event, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := `["Message\ndetail\nstate"="running" []]["Other"=1 []]`
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	// FlattenValue decodes the same embedded documents.
+	var v map[string]interface{}
+	if err := json.Unmarshal(event, &v); err != nil {
+		t.Fatal(err)
+	}
+	fields, err = fj.FlattenValue(v)
+	if err != nil {
+		t.Fatal("FlattenValue: " + err.Error())
+	}
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("FlattenValue: wanted %s got %s", wanted, got)
+	}
+}
+
+func gzipBase64(t *testing.T, doc string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func Test_Embedded_KinesisRecord(t *testing.T) {
+	data := gzipBase64(t, `{"logGroup":"/aws/lambda/orders","logEvents":[{"id":"1"}],"owner":"1234"}`)
+	event := []byte(`{"kinesis":{"partitionKey":"p-1","data":"` + data + `"},"eventSource":"aws:kinesis"}`)
+
+	paths := NewPaths()
+	paths.Add("kinesis\npartitionKey")
+	paths.Add("kinesis\ndata\nlogGroup")
+	paths.Add("kinesis\ndata\nowner")
+	paths.Add("eventSource")
+	paths.AddEncodedJSON("kinesis\ndata", 0, DecodeBase64, DecodeGzip)
+
+	fj := NewJxFlattener(paths)
+	wanted := []quamina.Field{
+		{Path: []byte("kinesis\npartitionKey"), Val: []byte(`"p-1"`)},
+		{Path: []byte("kinesis\ndata\nlogGroup"), Val: []byte(`"/aws/lambda/orders"`)},
+		{Path: []byte("kinesis\ndata\nowner"), Val: []byte(`"1234"`)},
+		{Path: []byte("eventSource"), Val: []byte(`"aws:kinesis"`)},
+	}
+
+	// Flatten twice to make sure the reused gzip reader is reset.
+	for i := 0; i < 2; i++ {
+		fields, err := fj.Flatten(event, nil)
+		if err != nil {
+			t.Fatal("Flatten: " + err.Error())
+		}
+		if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+			t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+		}
+	}
+
+	// Base64 only, without padding.
+	paths.AddEncodedJSON("kinesis\ndata", 0, DecodeBase64)
+	plain := base64.RawStdEncoding.EncodeToString([]byte(`{"owner":"5678"}`))
+
+	fields, err := fj.Flatten([]byte(`{"kinesis":{"data":"`+plain+`"}}`), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	want := fieldsSet([]quamina.Field{{Path: []byte("kinesis\ndata\nowner"), Val: []byte(`"5678"`)}})
+	if got := fieldsSet(fields); got != want {
+		t.Errorf("wanted %s got %s", want, got)
+	}
+}
+
+func Test_Embedded_DecodeLimits(t *testing.T) {
+	// 1MB of zeros compresses to about a kilobyte.
+	bomb := gzipBase64(t, `{"pad":"`+strings.Repeat("0", 1024*1024)+`"}`)
+	event := []byte(`{"data":"` + bomb + `"}`)
+
+	paths := NewPaths()
+	paths.Add("data\npad")
+	paths.AddEncodedJSON("data", 64*1024, DecodeBase64, DecodeGzip)
+
+	fj := NewJxFlattener(paths)
+	if _, err := fj.Flatten(event, nil); err == nil || !strings.Contains(err.Error(), "more than 65536 bytes") {
+		t.Errorf("wanted size limit error, got %v", err)
+	}
+
+	if _, err := fj.Flatten([]byte(`{"data":"not base64!"}`), nil); err == nil {
+		t.Error("wanted error for invalid base64")
+	}
+	if _, err := fj.Flatten([]byte(`{"data":"bm90IGd6aXA="}`), nil); err == nil {
+		t.Error("wanted error for invalid gzip")
+	}
+}
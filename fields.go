@@ -0,0 +1,43 @@
+package flattener
+
+import (
+	"github.com/timbray/quamina"
+)
+
+// CopyFields appends deep copies of fields to dst, so they stay valid after the event
+// and the flattener which produced them are reused.
+//
+//	The paths, values and array trails of all the fields are copied into a single
+//	allocation each.
+func CopyFields(dst []quamina.Field, fields []quamina.Field) []quamina.Field {
+	size, trails := 0, 0
+	for _, f := range fields {
+		size += len(f.Path) + len(f.Val)
+		trails += len(f.ArrayTrail)
+	}
+
+	buf := make([]byte, 0, size)
+	trailBuf := make([]quamina.ArrayPos, 0, trails)
+
+	for _, f := range fields {
+		c := quamina.Field{}
+
+		start := len(buf)
+		buf = append(buf, f.Path...)
+		c.Path = buf[start:len(buf):len(buf)]
+
+		start = len(buf)
+		buf = append(buf, f.Val...)
+		c.Val = buf[start:len(buf):len(buf)]
+
+		if f.ArrayTrail != nil {
+			start = len(trailBuf)
+			trailBuf = append(trailBuf, f.ArrayTrail...)
+			c.ArrayTrail = trailBuf[start:len(trailBuf):len(trailBuf)]
+		}
+
+		dst = append(dst, c)
+	}
+
+	return dst
+}
@@ -0,0 +1,119 @@
+package flattener
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+// fieldsSet renders fields in a stable, comparable form, quamina doesn't care about
+// the order fields are emitted in.
+func fieldsSet(fields []quamina.Field) string {
+	rendered := make([]string, 0, len(fields))
+	for _, f := range fields {
+		rendered = append(rendered, fmt.Sprintf("[%q=%s %v]", f.Path, f.Val, f.ArrayTrail))
+	}
+	sort.Strings(rendered)
+	return strings.Join(rendered, "")
+}
+
+func Test_Fields_FlattenInto(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("tags")
+
+	fj := NewJxFlattener(paths)
+	first, err := fj.FlattenInto(nil, []byte(`{"id":"a","tags":[1,2]}`))
+	if err != nil {
+		t.Fatal("FlattenInto: " + err.Error())
+	}
+
+	// The fields are appended to dst, and the slice isn't reused by the next call.
+	dst := make([]quamina.Field, 1, 8)
+	second, err := fj.FlattenInto(dst, []byte(`{"id":"b"}`))
+	if err != nil {
+		t.Fatal("FlattenInto: " + err.Error())
+	}
+	if len(second) != 2 || &second[0] != &dst[0] {
+		t.Errorf("wanted the fields appended to dst, got %d fields", len(second))
+	}
+	if got, wanted := fieldsSet(second[1:]), `["id"="b" []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if got, wanted := fieldsSet(first), `["id"="a" []]["tags"=1 [{1 1}]]["tags"=2 [{1 2}]]`; got != wanted {
+		t.Errorf("first call fields changed, wanted %s got %s", wanted, got)
+	}
+}
+
+func Test_Fields_CopyFields(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("tags")
+
+	event := []byte(`{"id":"a","tags":[1,2]}`)
+	fj := NewJxFlattener(paths)
+	fields, err := fj.Flatten(event, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	wanted := fieldsSet(fields)
+
+	copied := CopyFields(nil, fields)
+
+	// Reuse both the event and the flattener.
+	copy(event, bytes.Repeat([]byte(" "), len(event)))
+	if _, err := fj.Flatten([]byte(`{"id":"b","tags":[[3]]}`), nil); err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	if got := fieldsSet(copied); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if copied[0].ArrayTrail != nil {
+		t.Errorf("wanted no array trail for a field outside of arrays, got %v", copied[0].ArrayTrail)
+	}
+}
+
+func Test_Fields_FlattenFunc(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("tags")
+	paths.Add("user\nname")
+
+	event := []byte(`{"id":"a","tags":[1,2,3],"user":{"name":"yosi"},"broken":}`)
+	fj := NewJxFlattener(paths)
+
+	// Stopping at the second tag never reaches the rest of the event (which is malformed).
+	var got []quamina.Field
+	err := fj.FlattenFunc(event, func(f quamina.Field) bool {
+		got = CopyFields(got, []quamina.Field{f})
+		return len(got) < 3
+	})
+	if err != nil {
+		t.Fatal("FlattenFunc: " + err.Error())
+	}
+	if got, wanted := fieldsSet(got), `["id"="a" []]["tags"=1 [{1 1}]]["tags"=2 [{1 2}]]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	// Without stopping, every field is passed and errors are returned.
+	paths.Add("other")
+	count := 0
+	err = fj.FlattenFunc(event, func(f quamina.Field) bool {
+		count++
+		return true
+	})
+	if err == nil || count != 5 {
+		t.Errorf("wanted 5 fields and an error, got %d and %v", count, err)
+	}
+
+	// The flattener collects fields again afterwards.
+	fields, err := fj.Flatten([]byte(`{"id":"b"}`), nil)
+	if err != nil || len(fields) != 1 {
+		t.Errorf("wanted a single field, got %d and %v", len(fields), err)
+	}
+}
@@ -2,12 +2,18 @@ module github.com/yosiat/quamina-flatenner
 
 go 1.19
 
+require (
+	github.com/go-faster/jx v0.39.0
+	github.com/json-iterator/go v1.1.12
+	github.com/timbray/quamina v0.2.0
+	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/go-faster/errors v0.6.1 // indirect
-	github.com/go-faster/jx v0.39.0 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/segmentio/asm v1.2.0 // indirect
-	github.com/timbray/quamina v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 )
-
-replace github.com/timbray/quamina => /Users/yosi/gohack/github.com/timbray/quamina
@@ -0,0 +1,632 @@
+package flattener
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-faster/jx"
+	"github.com/timbray/quamina"
+)
+
+// FlattenValue flattens a Go value (a map with string keys, a struct or a pointer to one)
+// without marshalling it to JSON first.
+//
+//	The fields are identical to what Flatten would return for json.Marshal(v): json struct
+//	tags are honored, maps are walked in sorted key order and values implementing
+//	json.Marshaler or encoding.TextMarshaler are marshalled and flattened as JSON.
+func (fj *JxFlattener) FlattenValue(v interface{}) ([]quamina.Field, error) {
+	fj.reset()
+
+	gv, err := fj.resolveGoValue(reflect.ValueOf(v))
+	if err != nil {
+		return fj.fields, err
+	}
+
+	switch {
+	case gv.raw != nil && gv.kind == jx.Object:
+		err = fj.traverseRaw(gv.raw, func() error { return fj.traverseNode(fj.paths) })
+	case gv.raw == nil && gv.kind == jx.Object:
+		err = fj.traverseValueNode(gv.v, fj.paths)
+	default:
+		err = fmt.Errorf("FlattenValue: expected an object, got %s", gv.kind)
+	}
+
+	return fj.fields, err
+}
+
+// goValue is a Go value resolved to the JSON type it would be marshalled as.
+//
+//	raw holds the JSON of values implementing json.Marshaler or encoding.TextMarshaler.
+type goValue struct {
+	v    reflect.Value
+	raw  []byte
+	kind jx.Type
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonNumberType    = reflect.TypeOf(json.Number(""))
+)
+
+// resolveGoValue follows pointers and interfaces the same way encoding/json does.
+func (fj *JxFlattener) resolveGoValue(v reflect.Value) (goValue, error) {
+	for {
+		if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return goValue{kind: jx.Null}, nil
+		}
+
+		if raw, ok, err := marshalGoValue(v); ok {
+			if err != nil {
+				return goValue{}, err
+			}
+			return goValue{raw: raw, kind: rawJSONType(raw)}, nil
+		}
+
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return goValue{v: v, kind: jx.Bool}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return goValue{v: v, kind: jx.Number}, nil
+	case reflect.String:
+		if v.Type() == jsonNumberType {
+			return goValue{v: v, kind: jx.Number}, nil
+		}
+		return goValue{v: v, kind: jx.String}, nil
+	case reflect.Struct:
+		return goValue{v: v, kind: jx.Object}, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return goValue{kind: jx.Null}, nil
+		}
+		return goValue{v: v, kind: jx.Object}, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return goValue{kind: jx.Null}, nil
+		}
+		if isGoBytes(v.Type()) {
+			return goValue{v: v, kind: jx.String}, nil
+		}
+		return goValue{v: v, kind: jx.Array}, nil
+	case reflect.Array:
+		return goValue{v: v, kind: jx.Array}, nil
+	}
+
+	return goValue{}, fmt.Errorf("FlattenValue: unsupported type %s", v.Type())
+}
+
+// marshalGoValue marshals values implementing json.Marshaler or encoding.TextMarshaler,
+// the output is compacted and HTML-escaped like json.Marshal does.
+func marshalGoValue(v reflect.Value) ([]byte, bool, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, false, nil
+	}
+
+	var m interface{}
+	switch cachedGoMarshaling(v.Type()) {
+	case goMarshalValue:
+		m = v.Interface()
+	case goMarshalAddr:
+		if !v.CanAddr() {
+			return nil, false, nil
+		}
+		m = v.Addr().Interface()
+	default:
+		return nil, false, nil
+	}
+
+	if jm, ok := m.(json.Marshaler); ok {
+		b, err := jm.MarshalJSON()
+		if err != nil {
+			return nil, true, fmt.Errorf("FlattenValue: MarshalJSON of %s: %s", v.Type(), err)
+		}
+
+		var compact, escaped bytes.Buffer
+		if err := json.Compact(&compact, b); err != nil {
+			return nil, true, fmt.Errorf("FlattenValue: MarshalJSON of %s: %s", v.Type(), err)
+		}
+		json.HTMLEscape(&escaped, compact.Bytes())
+		return escaped.Bytes(), true, nil
+	}
+
+	text, err := m.(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return nil, true, fmt.Errorf("FlattenValue: MarshalText of %s: %s", v.Type(), err)
+	}
+	return appendJSONString(nil, string(text), true), true, nil
+}
+
+// goMarshaling tells how a type is marshalled by a json.Marshaler or encoding.TextMarshaler,
+// through the value itself or through a pointer to it (only possible when it's addressable).
+type goMarshaling uint8
+
+const (
+	goMarshalNone goMarshaling = iota
+	goMarshalValue
+	goMarshalAddr
+)
+
+var goMarshalings sync.Map // map[reflect.Type]goMarshaling
+
+func cachedGoMarshaling(t reflect.Type) goMarshaling {
+	if m, ok := goMarshalings.Load(t); ok {
+		return m.(goMarshaling)
+	}
+
+	m := goMarshalNone
+	switch {
+	case t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType):
+		m = goMarshalValue
+	case t.Kind() != reflect.Ptr && (reflect.PtrTo(t).Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)):
+		m = goMarshalAddr
+	}
+
+	goMarshalings.Store(t, m)
+	return m
+}
+
+// rawJSONType is the type of a compacted JSON value, by its first byte.
+func rawJSONType(raw []byte) jx.Type {
+	switch raw[0] {
+	case '{':
+		return jx.Object
+	case '[':
+		return jx.Array
+	case '"':
+		return jx.String
+	case 't', 'f':
+		return jx.Bool
+	case 'n':
+		return jx.Null
+	}
+	return jx.Number
+}
+
+func isGoBytes(t reflect.Type) bool {
+	elem := t.Elem()
+	return elem.Kind() == reflect.Uint8 && !reflect.PtrTo(elem).Implements(jsonMarshalerType) && !reflect.PtrTo(elem).Implements(textMarshalerType)
+}
+
+// traverseRaw runs f with the tokenizer pointed at raw JSON (a marshalled value or an
+// embedded document), which is traversed as a document of its own.
+func (fj *JxFlattener) traverseRaw(raw []byte, f func() error) error {
+	tok, depth := fj.tok, fj.depth
+	fj.tok, fj.depth = fj.getTokenizer(raw), 0
+	defer func() {
+		fj.putTokenizer(fj.tok)
+		fj.tok, fj.depth = tok, depth
+	}()
+
+	return f()
+}
+
+// Traverse an object value - the equivalent of traverseNode.
+func (fj *JxFlattener) traverseValueNode(v reflect.Value, n Node) error {
+	if v.Kind() == reflect.Map {
+		return fj.traverseValueMap(v, n)
+	}
+
+	for _, f := range cachedGoStructPlan(v.Type()) {
+		fv, ok := goFieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyGoValue(fv) {
+			continue
+		}
+
+		if err := fj.traverseValueEntry(f.name, fv, f.quoted, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type goMapEntry struct {
+	key string
+	v   reflect.Value
+}
+
+func (fj *JxFlattener) traverseValueMap(v reflect.Value, n Node) error {
+	nodeFields := n.getFields()
+
+	// Only the keys in the index matter, sort just them to get the same order as json.Marshal.
+	entries := make([]goMapEntry, 0)
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := goMapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+
+		_, isNode := n.get(key)
+		if _, isField := nodeFields[key]; isField || isNode {
+			entries = append(entries, goMapEntry{key: key, v: iter.Value()})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	for _, e := range entries {
+		if err := fj.traverseValueEntry(e.key, e.v, false, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func goMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+
+	return "", fmt.Errorf("FlattenValue: unsupported map key type %s", k.Type())
+}
+
+// traverseValueEntry handles a single object property, following the same rules as traverseNode.
+func (fj *JxFlattener) traverseValueEntry(key string, v reflect.Value, quoted bool, n Node) error {
+	node, isNode := n.get(key)
+	path, isField := n.getFields()[key]
+	if !isNode && !isField {
+		return nil
+	}
+
+	gv, err := fj.resolveGoValue(v)
+	if err != nil {
+		return err
+	}
+
+	if gv.kind == jx.Object {
+		if !isNode {
+			return nil
+		}
+		if gv.raw != nil {
+			return fj.traverseRaw(gv.raw, func() error { return fj.traverseNode(node) })
+		}
+		return fj.traverseValueNode(gv.v, node)
+	}
+
+	if isNode && gv.kind == jx.String && gv.raw == nil && gv.v.Kind() == reflect.String && node.isEmbeddedJSON() {
+		if isField {
+			val, err := fj.goPrimitiveValue(gv, quoted)
+			if err != nil {
+				return err
+			}
+			if err := fj.storeField(path, val); err != nil {
+				return err
+			}
+		}
+
+		start := len(fj.values)
+		fj.values = append(fj.values, gv.v.String()...)
+		return fj.traverseEmbeddedJSON(node, fj.values[start:len(fj.values):len(fj.values)])
+	}
+
+	if gv.kind == jx.Array {
+		if !isField {
+			path = nil
+		}
+		if !isNode {
+			node = nil
+		}
+		if gv.raw != nil {
+			return fj.traverseRaw(gv.raw, func() error { return fj.parseArrayField(path, node) })
+		}
+		return fj.traverseValueArray(path, node, gv.v)
+	}
+
+	if !isField {
+		return nil
+	}
+
+	val, err := fj.goPrimitiveValue(gv, quoted)
+	if err != nil {
+		return err
+	}
+	return fj.storeField(path, val)
+}
+
+// Equivalent of parseArrayField.
+func (fj *JxFlattener) traverseValueArray(path []byte, node Node, v reflect.Value) error {
+	fj.enterArray()
+	defer fj.leaveArray()
+
+	for i := 0; i < v.Len(); i++ {
+		fj.stepOneArrayElement()
+
+		gv, err := fj.resolveGoValue(v.Index(i))
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case gv.kind == jx.Object && node == nil:
+		case gv.kind == jx.Object && gv.raw != nil:
+			if err := fj.traverseRaw(gv.raw, func() error { return fj.traverseNode(node) }); err != nil {
+				return err
+			}
+		case gv.kind == jx.Object:
+			if err := fj.traverseValueNode(gv.v, node); err != nil {
+				return err
+			}
+		case gv.kind == jx.Array && gv.raw != nil:
+			if err := fj.traverseRaw(gv.raw, func() error { return fj.parseArrayField(path, node) }); err != nil {
+				return err
+			}
+		case gv.kind == jx.Array:
+			if err := fj.traverseValueArray(path, node, gv.v); err != nil {
+				return err
+			}
+		case path == nil:
+		default:
+			val, err := fj.goPrimitiveValue(gv, false)
+			if err != nil {
+				return err
+			}
+			if err := fj.storeArrayElementField(path, val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// goPrimitiveValue renders a primitive the way json.Marshal would, quoted is the ",string" option.
+func (fj *JxFlattener) goPrimitiveValue(gv goValue, quoted bool) ([]byte, error) {
+	if gv.raw != nil {
+		return bytes.Trim(gv.raw, " "), nil
+	}
+
+	start := len(fj.values)
+	v := gv.v
+
+	switch gv.kind {
+	case jx.Null:
+		fj.values = append(fj.values, "null"...)
+	case jx.Bool:
+		fj.values = strconv.AppendBool(fj.values, v.Bool())
+	case jx.Number:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fj.values = strconv.AppendInt(fj.values, v.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			fj.values = strconv.AppendUint(fj.values, v.Uint(), 10)
+		case reflect.Float32, reflect.Float64:
+			f := v.Float()
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, fmt.Errorf("FlattenValue: unsupported value %s", strconv.FormatFloat(f, 'g', -1, 64))
+			}
+			fj.values = appendJSONFloat(fj.values, f, v.Type().Bits())
+		case reflect.String:
+			// json.Number
+			num := v.String()
+			if num == "" {
+				num = "0"
+			}
+			if !isJSONNumber(num) {
+				return nil, fmt.Errorf("FlattenValue: invalid number literal %q", num)
+			}
+			fj.values = append(fj.values, num...)
+		}
+	case jx.String:
+		if v.Kind() == reflect.String {
+			fj.values = appendJSONString(fj.values, v.String(), true)
+		} else {
+			b := v.Bytes()
+			fj.values = append(fj.values, '"')
+			n := len(fj.values)
+			fj.values = append(fj.values, make([]byte, base64.StdEncoding.EncodedLen(len(b)))...)
+			base64.StdEncoding.Encode(fj.values[n:], b)
+			fj.values = append(fj.values, '"')
+		}
+	}
+
+	if quoted && gv.kind != jx.Null && (gv.kind != jx.String || v.Kind() == reflect.String) {
+		inner := string(fj.values[start:])
+		fj.values = appendJSONString(fj.values[:start], inner, true)
+	}
+
+	return fj.values[start:len(fj.values):len(fj.values)], nil
+}
+
+func isEmptyGoValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// goFieldByIndex is reflect.Value.FieldByIndex, reporting nil embedded pointers instead of panicking.
+func goFieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// goFieldPlan is a struct field as encoding/json sees it.
+type goFieldPlan struct {
+	name      string
+	index     []int
+	tagged    bool
+	omitEmpty bool
+	quoted    bool
+}
+
+var goStructPlans sync.Map // map[reflect.Type][]goFieldPlan
+
+func cachedGoStructPlan(t reflect.Type) []goFieldPlan {
+	if plan, ok := goStructPlans.Load(t); ok {
+		return plan.([]goFieldPlan)
+	}
+
+	plan, _ := goStructPlans.LoadOrStore(t, goStructPlan(t))
+	return plan.([]goFieldPlan)
+}
+
+// goStructPlan lists the fields json.Marshal would encode for a struct type, with the same
+// rules for embedded structs: fields of embedded structs are promoted, a shallower field
+// hides deeper ones and among fields of the same depth a tagged one wins.
+func goStructPlan(t reflect.Type) []goFieldPlan {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	var fields []goFieldPlan
+	next := []embedded{{typ: t}}
+	visited := make(map[reflect.Type]bool)
+
+	for len(next) > 0 {
+		current := next
+		next = nil
+
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				if sf.Anonymous {
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: ft, index: index})
+					continue
+				}
+
+				plan := goFieldPlan{name: name, index: index, tagged: name != ""}
+				if name == "" {
+					plan.name = sf.Name
+				}
+				for _, opt := range strings.Split(opts, ",") {
+					switch opt {
+					case "omitempty":
+						plan.omitEmpty = true
+					case "string":
+						switch ft.Kind() {
+						case reflect.Bool, reflect.String,
+							reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+							reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+							reflect.Float32, reflect.Float64:
+							plan.quoted = true
+						}
+					}
+				}
+				fields = append(fields, plan)
+			}
+		}
+	}
+
+	return dominantGoFields(fields)
+}
+
+func dominantGoFields(fields []goFieldPlan) []goFieldPlan {
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].name != fields[j].name {
+			return fields[i].name < fields[j].name
+		}
+		if len(fields[i].index) != len(fields[j].index) {
+			return len(fields[i].index) < len(fields[j].index)
+		}
+		return fields[i].tagged && !fields[j].tagged
+	})
+
+	out := make([]goFieldPlan, 0, len(fields))
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+
+		// fields[i:j] share a name, sorted by depth and tagged first.
+		group := fields[i:j]
+		if len(group) == 1 || len(group[0].index) < len(group[1].index) || group[0].tagged && !group[1].tagged {
+			out = append(out, group[0])
+		}
+		i = j
+	}
+
+	// Back to declaration order.
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].index, out[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	return out
+}
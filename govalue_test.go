@@ -0,0 +1,150 @@
+package flattener
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+type goAddress struct {
+	City    string   `json:"city"`
+	Zip     *int     `json:"zip,omitempty"`
+	Unknown []string `json:"-"`
+}
+
+type goAudit struct {
+	CreatedBy string `json:"createdBy"`
+	Version   int
+}
+
+type goOrder struct {
+	goAudit
+	ID        string                 `json:"id"`
+	Amount    float64                `json:"amount"`
+	Count     int64                  `json:"count,string"`
+	Paid      bool                   `json:"paid"`
+	Note      string                 `json:"note,omitempty"`
+	Tags      []string               `json:"tags"`
+	Matrix    [][]float32            `json:"matrix"`
+	Items     []interface{}          `json:"items"`
+	Address   *goAddress             `json:"address"`
+	Billing   *goAddress             `json:"billing"`
+	Extra     map[string]interface{} `json:"extra"`
+	Created   time.Time              `json:"created"`
+	IP        net.IP                 `json:"ip"`
+	Raw       json.RawMessage        `json:"raw"`
+	Payload   []byte                 `json:"payload"`
+	Number    json.Number            `json:"number"`
+	unexposed string
+}
+
+func goOrderValue() goOrder {
+	zip := 6100
+	return goOrder{
+		goAudit: goAudit{CreatedBy: "yosi", Version: 3},
+		ID:      `<A&B> "17"`,
+		Amount:  1e21,
+		Count:   42,
+		Paid:    true,
+		Tags:    []string{"a", "b"},
+		Matrix:  [][]float32{{1.5, 2}, {0.000001}},
+		Items:   []interface{}{1, map[string]interface{}{"sku": "x"}, "two", nil},
+		Address: &goAddress{City: "Tel Aviv", Zip: &zip, Unknown: []string{"x"}},
+		Extra: map[string]interface{}{
+			"b": map[string]interface{}{"deep": []interface{}{true, false}},
+			"a": 1.25,
+		},
+		Created:   time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC),
+		IP:        net.IPv4(10, 0, 0, 1),
+		Raw:       json.RawMessage(`{ "kind" : "raw", "list": [1, 2] }`),
+		Payload:   []byte("hello"),
+		Number:    json.Number("12.50"),
+		unexposed: "hidden",
+	}
+}
+
+var goOrderPaths = []string{
+	"createdBy", "Version", "id", "amount", "count", "paid", "note", "tags", "matrix", "items", "items\nsku",
+	"address\ncity", "address\nzip", "billing\ncity", "extra\na", "extra\nb\ndeep",
+	"created", "ip", "raw\nkind", "raw\nlist", "payload", "number",
+}
+
+func Test_GoValue_MatchesMarshalledJSON(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range goOrderPaths {
+		paths.Add(path)
+	}
+
+	values := []interface{}{
+		goOrderValue(),
+		&goOrder{ID: "empty"},
+		map[string]interface{}{"id": "from-map", "tags": []string{"x"}, "address": map[string]string{"city": "Haifa"}},
+	}
+
+	for _, v := range values {
+		event, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal("Marshal: " + err.Error())
+		}
+
+		jxFields, err := NewJxFlattener(paths).Flatten(event, nil)
+		if err != nil {
+			t.Fatal("Flatten: " + err.Error())
+		}
+		valueFields, err := NewJxFlattener(paths).FlattenValue(v)
+		if err != nil {
+			t.Fatal("FlattenValue: " + err.Error())
+		}
+
+		if got, wanted := fieldsSet(valueFields), fieldsSet(jxFields); got != wanted {
+			t.Errorf("FlattenValue differs from Flatten for %s\ngot:    %s\nwanted: %s", event, got, wanted)
+		}
+	}
+}
+
+func Test_GoValue_Errors(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("f")
+
+	fj := NewJxFlattener(paths)
+	if _, err := fj.FlattenValue([]string{"not", "an", "object"}); err == nil {
+		t.Error("wanted error for a non-object value")
+	}
+	if _, err := fj.FlattenValue(map[string]interface{}{"f": make(chan int)}); err == nil {
+		t.Error("wanted error for an unsupported type")
+	}
+}
+
+func Benchmark_GoValue(b *testing.B) {
+	// A typical pattern set only looks at a few of the fields.
+	paths := NewPaths()
+	for _, path := range []string{"id", "paid", "tags", "address\ncity"} {
+		paths.Add(path)
+	}
+	v := goOrderValue()
+
+	b.Run("FlattenValue", func(b *testing.B) {
+		fj := NewJxFlattener(paths)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := fj.FlattenValue(&v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("MarshalAndFlatten", func(b *testing.B) {
+		fj := NewJxFlattener(paths)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			event, err := json.Marshal(&v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := fj.Flatten(event, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -1,7 +1,11 @@
-package main
+// Package flattener is a flattener for quamina which only parses the parts of an event
+// the patterns match on, the paths of the patterns are kept in a PathIndex.
+package flattener
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"unsafe"
 
@@ -9,140 +13,293 @@ import (
 	"github.com/timbray/quamina"
 )
 
-type jxFlattener struct {
+type JxFlattener struct {
 	paths PathIndex
 
 	fields     []quamina.Field
-	dcd        *jx.Decoder
+	tok        Tokenizer
 	arrayCount int32
 	arrayTrail []quamina.ArrayPos
+
+	// trails is an arena for the ArrayTrail of the fields, so storing an array element
+	// doesn't allocate. Like the fields, it's reused by the next Flatten.
+	trails []quamina.ArrayPos
+
+	// depth is the number of objects traverseNode is inside of.
+	depth int
+
+	// values holds values rendered or decoded while flattening (by FlattenValue and
+	// embedded JSON), the fields point into it.
+	values []byte
+
+	// gzip is reused for decompressing embedded values.
+	gzip *gzip.Reader
+
+	// events is reused by FlattenAll.
+	events []FlattenedEvent
+
+	// fn receives the fields instead of collecting them, see FlattenFunc.
+	fn func(quamina.Field) bool
+
+	// lenient normalizes JSONC / JSON5-like events before flattening them, see WithLenientJSON.
+	lenient bool
+
+	// shapes are the key layouts learned for the nodes when the shape cache is enabled
+	// (nil otherwise), see WithShapeCache.
+	shapes      map[*nodeSettings]*nodeShape
+	shapeHits   uint64
+	shapeMisses uint64
+
+	// newTokenizer creates the tokenizers (jx when nil), see WithTokenizer. Tokenizers
+	// which aren't in use are kept in tokenizers.
+	newTokenizer func() Tokenizer
+	tokenizers   []Tokenizer
+
+	// metrics observes every event when set, see WithMetrics. stats are the counts of
+	// the event being flattened.
+	metrics Metrics
+	stats   eventStats
+
+	// tracer receives the steps of flattening when set, see WithTracer.
+	tracer Tracer
 }
 
-func newJxFlattener(paths PathIndex) *jxFlattener {
-	return &jxFlattener{
+// Option configures a JxFlattener.
+type Option func(fj *JxFlattener)
+
+// NewJxFlattener creates a flattener for JSON events, emitting the fields in paths.
+func NewJxFlattener(paths PathIndex, opts ...Option) *JxFlattener {
+	fj := &JxFlattener{
 		paths:      paths,
 		fields:     make([]quamina.Field, 0),
 		arrayTrail: make([]quamina.ArrayPos, 0),
 		arrayCount: 0,
 	}
+	for _, opt := range opts {
+		opt(fj)
+	}
+
+	return fj
 }
 
-func (fj *jxFlattener) Copy() quamina.Flattener {
-	return &jxFlattener{
-		paths:      fj.paths,
-		fields:     make([]quamina.Field, 0),
-		arrayTrail: make([]quamina.ArrayPos, 0),
-		arrayCount: 0,
+func (fj *JxFlattener) Copy() quamina.Flattener {
+	c := &JxFlattener{
+		paths:        fj.paths,
+		fields:       make([]quamina.Field, 0),
+		arrayTrail:   make([]quamina.ArrayPos, 0),
+		arrayCount:   0,
+		lenient:      fj.lenient,
+		newTokenizer: fj.newTokenizer,
+		metrics:      fj.metrics,
+		tracer:       fj.tracer,
+	}
+	if fj.shapes != nil {
+		c.shapes = make(map[*nodeSettings]*nodeShape)
 	}
+
+	return c
 }
 
-func (fj *jxFlattener) reset() {
+func (fj *JxFlattener) reset() {
 	fj.arrayCount = 0
 	fj.fields = fj.fields[:0]
 	fj.arrayTrail = fj.arrayTrail[:0]
+	fj.trails = fj.trails[:0]
+	fj.values = fj.values[:0]
 }
 
-func (fj *jxFlattener) getDecoder(event []byte) *jx.Decoder {
-	dcd := jx.GetDecoder()
-	dcd.ResetBytes(event)
+func (fj *JxFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	fj.reset()
 
-	return dcd
+	if err := fj.flattenEvent(event); err != nil {
+		return fj.fields, err
+	}
+
+	return fj.fields, nil
 }
 
-func (fj *jxFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+// FlattenInto flattens an event, appending its fields to dst and returning it. Unlike
+// Flatten, the returned slice is owned by the caller and isn't reused by the flattener.
+//
+//	The fields still alias memory the caller doesn't own: Path points into the PathIndex
+//	(which never changes it), Val points into the event, and ArrayTrail and values which
+//	were rendered or decoded (lenient or embedded JSON) point into the flattener's
+//	buffers. So a field is valid until the event is modified or the flattener is used
+//	again, callers retaining fields past that should use CopyFields.
+func (fj *JxFlattener) FlattenInto(dst []quamina.Field, event []byte) ([]quamina.Field, error) {
 	fj.reset()
 
-	//fmt.Println()
-	//fmt.Printf("Paths: %+v\n", fj.paths)
-	//fmt.Printf("Input: %s\n\n", string(event))
+	own := fj.fields
+	fj.fields = dst
+	defer func() { fj.fields = own }()
 
-	// Setup a decoder.
-	fj.dcd = fj.getDecoder(event)
-	defer jx.PutDecoder(fj.dcd)
+	err := fj.flattenEvent(event)
+	return fj.fields, err
+}
 
-	if err := fj.traverseNode(fj.paths); err != nil {
-		return fj.fields, err
-	}
+// FlattenFunc flattens an event, calling fn with every field as soon as it's parsed
+// instead of collecting them. Parsing stops as soon as fn returns false.
+//
+//	A field is valid only during the call to fn, use CopyFields to retain it.
+func (fj *JxFlattener) FlattenFunc(event []byte, fn func(quamina.Field) bool) error {
+	fj.reset()
 
-	//fmt.Printf("Finished flatenning\n")
-	//fmt.Println()
+	fj.fn = fn
+	defer func() { fj.fn = nil }()
 
-	return fj.fields, nil
+	if err := fj.flattenEvent(event); err != nil && !errors.Is(err, errStopFlattening) {
+		return err
+	}
+	return nil
 }
 
 // Traverse a node - all nodes are treated as objects.
 //
 //	Goes into it and find all sub-nodes and eventually all the fields.
-func (fj *jxFlattener) traverseNode(n Node) error {
+func (fj *JxFlattener) traverseNode(n Node) error {
+	fj.depth++
+	defer func() { fj.depth-- }()
+
 	nodeFields := n.getFields()
 	fieldsCount := len(nodeFields)
 
 	// Get count of how many nodes we have in this level.
 	// Once we get to count of zero, we know we can stop parsing.
 	nodesCount := n.nodesCount()
-	//fmt.Printf("Nodes: \"%s\" (count: %d), fields count: %d\n", strings.Join(n.names(), ", "), nodesCount, fieldsCount)
+	if fj.tracer != nil {
+		fj.tracer.Trace(TraceEvent{Kind: TraceEnterNode, Depth: fj.depth, Nodes: nodesCount, Fields: fieldsCount})
+	}
 
-	objIter, err := fj.dcd.ObjIter()
-	if err != nil {
+	if err := fj.tok.ObjStart(); err != nil {
 		return fmt.Errorf("failed traversing node: %s", err)
 	}
 
-	for objIter.Next() {
-		key := BinaryString(objIter.Key())
-		//fmt.Printf("[%s] entering\n", key)
+	filter := &n.getSettings().keys
+	shape := fj.shapeOf(n)
+	ordinal := 0
+
+	stopped := false
+	for {
+		keyBytes, ok, err := fj.tok.ObjNext()
+		if err != nil {
+			return fmt.Errorf("traverseNode: %s", err)
+		}
+		if !ok {
+			break
+		}
+
+		k := fj.lookupKey(n, nodeFields, filter, shape, ordinal, keyBytes)
+		node, found, path, isField := k.node, k.found, k.path, k.isField
+		ordinal++
 
 		// If the type of the current property is object
 		// let's check if it's a node, otherwise we are going to skip this property.
-		if fj.dcd.Next() == jx.Object {
-			if node, found := n.get(key); found {
+		if fj.tok.Next() == jx.Object {
+			if found {
+				if fj.tracer != nil {
+					fj.traceKey(keyBytes, true)
+				}
 				if err := fj.traverseNode(node); err != nil {
 					return err
 				}
 
 				nodesCount--
-				//fmt.Printf("\t[%s] Reducing nodes count, current is %d\n", key, nodesCount)
 
 				if fieldsCount == 0 && nodesCount == 0 {
-					//fmt.Printf("\t[%s] nodes > breaking.\n", key)
+					stopped = true
 					break
 				} else {
 					continue
 				}
 			}
-		} else {
-			path, isField := nodeFields[key]
-			if isField {
-				//fmt.Printf("\t[%s] is a field.\n", key)
-				if err := fj.parseField(path, n); err != nil {
-					return err
-				}
+		} else if found && node.isEmbeddedJSON() && fj.tok.Next() == jx.String {
+			if fj.tracer != nil {
+				fj.traceKey(keyBytes, true)
+			}
+			if err := fj.parseEmbeddedJSON(node, path, isField); err != nil {
+				return err
+			}
 
+			if isField {
 				fieldsCount--
+			}
+			nodesCount--
+			continue
+		} else if (found || isField) && fj.tok.Next() == jx.Array {
+			if fj.tracer != nil {
+				fj.traceKey(keyBytes, true)
+			}
+			if !isField {
+				path = nil
+			}
+			if !found {
+				node = nil
+			}
+			if err := fj.parseArrayField(path, node); err != nil {
+				return err
+			}
 
-				// We can't break here, since we might have to return
-				// to parent node, so we will need to parse more fields.
-				// I can come up with a way but I think it will be complex.
-				continue
+			if isField {
+				fieldsCount--
+			}
+			if found {
+				nodesCount--
+			}
+			continue
+		} else if isField {
+			if fj.tracer != nil {
+				fj.traceKey(keyBytes, true)
 			}
+			if err := fj.parseField(path, n); err != nil {
+				return err
+			}
+
+			fieldsCount--
+
+			// We can't break here, since we might have to return
+			// to parent node, so we will need to parse more fields.
+			// I can come up with a way but I think it will be complex.
+			continue
 		}
 
-		if err := fj.dcd.Skip(); err != nil {
+		if fj.tracer != nil {
+			fj.traceKey(keyBytes, false)
+		}
+		if err := fj.skip(); err != nil {
 			return fmt.Errorf("traverseNode: failed skipping: %s", err)
 		}
-		//fmt.Printf("\t[%s] finished\n", key)
 	}
-	//fmt.Printf("Finished Processing")
 
+	// Only the root can stop in the middle of the object, a nested object has to be
+	// consumed so the parent continues from its next key.
+	if stopped && fj.depth > 1 {
+		for {
+			keyBytes, ok, err := fj.tok.ObjNext()
+			if err != nil {
+				return fmt.Errorf("traverseNode: %s", err)
+			}
+			if !ok {
+				break
+			}
+			if fj.tracer != nil {
+				fj.traceKey(keyBytes, false)
+			}
+			if err := fj.skip(); err != nil {
+				return fmt.Errorf("traverseNode: failed skipping: %s", err)
+			}
+		}
+	} else if stopped {
+		fj.stats.earlyExit = true
+	}
+
+	if fj.tracer != nil {
+		fj.tracer.Trace(TraceEvent{Kind: TraceLeaveNode, Depth: fj.depth, Stopped: stopped})
+	}
 	return nil
 }
 
-func (fj *jxFlattener) parseField(path []byte, n Node) error {
-	typ := fj.dcd.Next()
-
-	if typ == jx.Array {
-		//fmt.Printf("\t\tparseField: %s\n", strings.ReplaceAll(string(path), "\n", "->"))
-		return fj.parseArrayField(path, n)
-	}
+func (fj *JxFlattener) parseField(path []byte, n Node) error {
+	typ := fj.tok.Next()
 
 	if typ == jx.String || typ == jx.Number || typ == jx.Bool || typ == jx.Null {
 		return fj.parsePrimitiveField(path, n)
@@ -151,28 +308,21 @@ func (fj *jxFlattener) parseField(path []byte, n Node) error {
 	return fmt.Errorf("parseField: don't know how to handle: %s", typ)
 }
 
-func (fj *jxFlattener) parsePrimitiveField(path []byte, n Node) error {
-	f := quamina.Field{}
-
+func (fj *JxFlattener) parsePrimitiveField(path []byte, n Node) error {
 	val, err := fj.getPrimitiveValue()
 	if err != nil {
 		return err
 	}
 
-	f.Val = val
-	f.Path = path
-	fj.fields = append(fj.fields, f)
-
-	return nil
-
+	return fj.storeField(path, val)
 }
 
-func (fj *jxFlattener) getPrimitiveValue() (val []byte, err error) {
+func (fj *JxFlattener) getPrimitiveValue() (val []byte, err error) {
 	// We wil use "Raw" value, since we want to return in the end byte array.
 	// It's important to note that "Raw" will return the value as is,
 	//   so for strings it will return them with quotes,
 	//   numbers in array it will returen them with spaces if there are any.
-	val, err = fj.dcd.Raw()
+	val, err = fj.tok.Raw()
 	if err != nil {
 		return
 	}
@@ -180,58 +330,119 @@ func (fj *jxFlattener) getPrimitiveValue() (val []byte, err error) {
 	return bytes.Trim(val, " "), err
 }
 
-func (fj *jxFlattener) parseArrayField(path []byte, n Node) error {
-	iter, err := fj.dcd.ArrIter()
-	if err != nil {
+// parseArrayField parses an array, its primitives are fields of path and its objects are
+// traversed against node. path is nil when the key isn't a field and node when it
+// isn't a node, those elements are skipped.
+func (fj *JxFlattener) parseArrayField(path []byte, node Node) error {
+	if err := fj.tok.ArrStart(); err != nil {
 		return err
 	}
 
 	fj.enterArray()
 	defer fj.leaveArray()
 
-	for iter.Next() {
+	for {
+		ok, err := fj.tok.ArrNext()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
 		fj.stepOneArrayElement()
+		if fj.tracer != nil {
+			fj.tracer.Trace(TraceEvent{Kind: TraceArrayStep, Depth: fj.depth, Field: quamina.Field{Path: path, ArrayTrail: fj.arrayTrail}})
+		}
 
-		typ := fj.dcd.Next()
+		typ := fj.tok.Next()
 
 		if typ == jx.Array {
 			// If value is an array, enter it.
-			if err := fj.parseArrayField(path, n); err != nil {
+			if err := fj.parseArrayField(path, node); err != nil {
 				return err
 			}
+			continue
 		}
 
-		if typ == jx.String || typ == jx.Number || typ == jx.Bool || typ == jx.Null {
+		if typ == jx.Object && node != nil {
+			// Objects are matched like quamina does, as if the array wasn't there.
+			if err := fj.traverseNode(node); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if path != nil && (typ == jx.String || typ == jx.Number || typ == jx.Bool || typ == jx.Null) {
 			// If it's primtive value append to the list.
 			val, err := fj.getPrimitiveValue()
 			if err != nil {
 				return err
 			}
 
-			fj.storeArrayElementField(path, val)
+			if err := fj.storeArrayElementField(path, val); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fj.skip(); err != nil {
+			return fmt.Errorf("parseArrayField: failed skipping: %s", err)
 		}
 	}
+}
 
-	return nil
+// storeField emits a field of an object, objects inside arrays are traversed too so their
+// fields carry the array trail.
+func (fj *JxFlattener) storeField(path []byte, val []byte) error {
+	if len(fj.arrayTrail) > 0 {
+		return fj.storeArrayElementField(path, val)
+	}
+	return fj.emit(quamina.Field{Path: path, Val: val})
+}
+
+func (fj *JxFlattener) storeArrayElementField(path []byte, val []byte) error {
+	// When the arena grows, fields stored before keep pointing into the previous one,
+	// which isn't written to anymore.
+	start := len(fj.trails)
+	fj.trails = append(fj.trails, fj.arrayTrail...)
 
+	f := quamina.Field{Path: path, ArrayTrail: fj.trails[start:len(fj.trails):len(fj.trails)], Val: val}
+	return fj.emit(f)
 }
 
-func (fj *jxFlattener) storeArrayElementField(path []byte, val []byte) {
-	f := quamina.Field{Path: path, ArrayTrail: make([]quamina.ArrayPos, len(fj.arrayTrail)), Val: val}
-	copy(f.ArrayTrail, fj.arrayTrail)
-	fj.fields = append(fj.fields, f)
+// errStopFlattening is returned by emit when the FlattenFunc callback asks to stop.
+var errStopFlattening = errors.New("flattening stopped")
+
+// emit is where all the fields of an event end, they are either collected or handed to
+// the FlattenFunc callback.
+func (fj *JxFlattener) emit(f quamina.Field) error {
+	fj.stats.fields++
+	if fj.tracer != nil {
+		fj.tracer.Trace(TraceEvent{Kind: TraceField, Depth: fj.depth, Field: f})
+	}
+
+	if fj.fn == nil {
+		fj.fields = append(fj.fields, f)
+		return nil
+	}
+
+	if !fj.fn(f) {
+		return errStopFlattening
+	}
+	return nil
 }
 
-func (fj *jxFlattener) enterArray() {
+func (fj *JxFlattener) enterArray() {
 	fj.arrayCount++
 	fj.arrayTrail = append(fj.arrayTrail, quamina.ArrayPos{Array: fj.arrayCount, Pos: 0})
 }
 
-func (fj *jxFlattener) leaveArray() {
+func (fj *JxFlattener) leaveArray() {
 	fj.arrayTrail = fj.arrayTrail[:len(fj.arrayTrail)-1]
 }
 
-func (fj *jxFlattener) stepOneArrayElement() {
+func (fj *JxFlattener) stepOneArrayElement() {
 	fj.arrayTrail[len(fj.arrayTrail)-1].Pos++
 }
 
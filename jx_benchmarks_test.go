@@ -1,6 +1,7 @@
-package main
+package flattener
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 	"runtime/debug"
@@ -14,10 +15,17 @@ import (
 func Test_JX_CRANLEIGH(t *testing.T) {
 	jCranleigh := `{ "type": "Feature", "properties": { "MAPBLKLOT": "7222001", "BLKLOT": "7222001", "BLOCK_NUM": "7222", "LOT_NUM": "001", "FROM_ST": "1", "TO_ST": "1", "STREET": "CRANLEIGH", "ST_TYPE": "DR", "ODD_EVEN": "O" }, "geometry": { "type": "Polygon", "coordinates": [ [ [ -122.472773074480756, 37.73439178240811, 0.0 ], [ -122.47278111723567, 37.73451247621523, 0.0 ], [ -122.47242608711845, 37.73452184591072, 0.0 ], [ -122.472418368113281, 37.734401143064396, 0.0 ], [ -122.472773074480756, 37.73439178240811, 0.0 ] ] ] } }`
 	j108492 := `{ "type": "Feature", "properties": { "MAPBLKLOT": "0011008", "BLKLOT": "0011008", "BLOCK_NUM": "0011", "LOT_NUM": "008", "FROM_ST": "500", "TO_ST": "550", "STREET": "BEACH", "ST_TYPE": "ST", "ODD_EVEN": "E" }, "geometry": { "type": "Polygon", "coordinates": [ [ [ -122.418114728237924, 37.807058866808987, 0.0 ], [ -122.418261722815416, 37.807807921694092, 0.0 ], [ -122.417544151208375, 37.807900142836701, 0.0 ], [ -122.417397010603693, 37.807150305505004, 0.0 ], [ -122.418114728237924, 37.807058866808987, 0.0 ] ] ] } }`
-	m := newCustomCoreMatcher()
 	pCranleigh := `{ "properties": { "STREET": [ "CRANLEIGH" ] } }`
 	p108492 := `{ "properties": { "MAPBLKLOT": ["0011008"], "BLKLOT": ["0011008"]},  "geometry": { "coordinates": [ 37.807807921694092 ] } } `
 
+	paths := NewPaths()
+	for _, pattern := range []string{pCranleigh, p108492} {
+		if err := paths.AddPattern(pattern); err != nil {
+			t.Error("addPattern: " + err.Error())
+		}
+	}
+	m := newCustomCoreMatcher(NewJxFlattener(paths))
+
 	err := m.AddPattern("CRANLEIGH", pCranleigh)
 	if err != nil {
 		t.Error("!? " + err.Error())
@@ -26,27 +34,12 @@ func Test_JX_CRANLEIGH(t *testing.T) {
 	if err != nil {
 		t.Error("!? " + err.Error())
 	}
-	fmt.Println(m.MatcherStats())
 
 	var matches []quamina.X
 	lines := [][]byte{[]byte(jCranleigh), []byte(j108492)}
 
-	paths := newPaths()
-	for path := range m.Paths() {
-		paths.add(path)
-	}
-	fj := newJxFlattener(paths)
-
 	for _, line := range lines {
-		fields, err := fj.Flatten(line, m)
-		if err != nil {
-			t.Error("Flatten: " + err.Error())
-		}
-		//printFields("JX", fields, line)
-		mm, err := m.MatchesForFields(fields)
-		if err != nil {
-			t.Error("Matches4JSON: " + err.Error())
-		}
+		mm, err := m.MatchesForEvent(line)
 		if err != nil {
 			t.Error("OOPS " + err.Error())
 		}
@@ -64,7 +57,6 @@ func Test_JX_CRANLEIGH(t *testing.T) {
 // exercise shellstyle matching a little, is much faster than TestCityLots because it's only working wth one field
 func Test_JX_BigShellStyle(t *testing.T) {
 	lines := getCityLotsLines(t)
-	m := newCustomCoreMatcher()
 
 	wanted := map[quamina.X]int{
 		"A": 5883, "B": 12765, "C": 14824, "D": 6124, "E": 3402, "F": 7999, "G": 8555,
@@ -73,6 +65,10 @@ func Test_JX_BigShellStyle(t *testing.T) {
 		"V": 4322, "W": 4162, "X": 0, "Y": 721, "Z": 25,
 	}
 
+	paths := NewPaths()
+	paths.Add("properties\nSTREET")
+	m := newCustomCoreMatcher(NewJxFlattener(paths))
+
 	for letter := range wanted {
 		pat := fmt.Sprintf(`{"properties": {"STREET":[ {"shellstyle": "%s*"} ] } }`, letter)
 		err := m.AddPattern(letter, pat)
@@ -81,22 +77,10 @@ func Test_JX_BigShellStyle(t *testing.T) {
 		}
 	}
 
-	fmt.Println(m.MatcherStats())
-
-	paths := newPaths()
-	for path := range m.Paths() {
-		paths.add(path)
-	}
-	fj := newJxFlattener(paths)
-
 	lCounts := make(map[quamina.X]int)
 	before := time.Now()
 	for _, line := range lines {
-		fields, err := fj.Flatten(line, m)
-		if err != nil {
-			t.Error("Flatten: " + err.Error())
-		}
-		matches, err := m.MatchesForFields(fields)
+		matches, err := m.MatchesForEvent(line)
 		if err != nil {
 			t.Error("Matches4JSON: " + err.Error())
 		}
@@ -129,6 +113,50 @@ func Test_JX_BigShellStyle(t *testing.T) {
 	*/
 }
 
+// Test_JX_BigShellStylePipeline is Test_JX_BigShellStyle with the events flattened and matched on all the cores.
+func Test_JX_BigShellStylePipeline(t *testing.T) {
+	lines := getCityLotsLines(t)
+
+	paths := NewPaths()
+	paths.Add("properties\nSTREET")
+	m := newCustomCoreMatcher(NewJxFlattener(paths))
+
+	for _, letter := range "ABCDEFGHIJKLMNOPQRSTUVWXYZ" {
+		pat := fmt.Sprintf(`{"properties": {"STREET":[ {"shellstyle": "%c*"} ] } }`, letter)
+		if err := m.AddPattern(string(letter), pat); err != nil {
+			t.Errorf("err on %c: %s", letter, err.Error())
+		}
+	}
+
+	p := NewPipeline(context.Background(), m, runtime.NumCPU(), false)
+	go func() {
+		for _, line := range lines {
+			if err := p.Submit(line); err != nil {
+				t.Error("Submit: " + err.Error())
+			}
+		}
+		p.Close()
+	}()
+
+	lCounts := make(map[quamina.X]int)
+	before := time.Now()
+	for r := range p.Results() {
+		if r.Err != nil {
+			t.Error("Pipeline: " + r.Err.Error())
+		}
+		for _, match := range r.Matches {
+			lCounts[match]++
+		}
+	}
+	elapsed := float64(time.Since(before).Milliseconds())
+	perSecond := float64(len(lines)) / (elapsed / 1000.0)
+	fmt.Printf("%.2f matches/second with letter patterns on %d workers\n\n", perSecond, runtime.NumCPU())
+
+	if lCounts["A"] != 5883 || lCounts["S"] != 13255 {
+		t.Errorf("wanted 5883 A and 13255 S, got %d and %d", lCounts["A"], lCounts["S"])
+	}
+}
+
 // TestPatternAddition adds a whole lot of string-only rules as fast as possible  The profiler says that the
 //
 //	performance is totally doinated by the garbage-collector thrashing, in particular it has to allocate
@@ -142,7 +170,7 @@ func Test_JX_PatternAddition(t *testing.T) {
 	var msBefore, msAfter runtime.MemStats
 
 	// now we're going to add 200 fields, 200 values, so 40K name/value pairs. There might be some duplication?
-	m := newCustomCoreMatcher()
+	m := newCustomCoreMatcher(NewJxFlattener(NewPaths()))
 	before := time.Now()
 	fieldCount := 0
 	runtime.ReadMemStats(&msBefore)
@@ -165,14 +193,34 @@ func Test_JX_PatternAddition(t *testing.T) {
 	runtime.ReadMemStats(&msAfter)
 	delta := 1.0 / 1000000.0 * float64(msAfter.Alloc-msBefore.Alloc)
 	fmt.Printf("before %d, after %d, delta %f\n", msBefore.Alloc, msAfter.Alloc, delta)
-	fmt.Println("stats:" + m.MatcherStats())
 	elapsed := float64(time.Since(before).Milliseconds())
 	perSecond := float64(fieldCount) / (elapsed / 1000.0)
 	fmt.Printf("%.2f fields/second\n\n", perSecond)
 }
 
-func newCustomCoreMatcher() *quamina.Quamina {
-	q, err := quamina.New()
+func Test_JX_TopLevelPaths(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("type")
+	paths.Add("properties\nSTREET")
+
+	fields, err := NewJxFlattener(paths).Flatten([]byte(`{ "type": "Feature", "id": 7, "properties": { "STREET": "CRANLEIGH" } }`), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := []string{"type", "properties\nSTREET"}
+	if len(fields) != len(wanted) {
+		t.Fatalf("wanted %d fields, got %d", len(wanted), len(fields))
+	}
+	for i, field := range fields {
+		if string(field.Path) != wanted[i] {
+			t.Errorf("wanted %q got %q", wanted[i], field.Path)
+		}
+	}
+}
+
+func newCustomCoreMatcher(flattener quamina.Flattener) *quamina.Quamina {
+	q, err := quamina.New(quamina.WithFlattener(flattener))
 	if err != nil {
 		panic(err)
 	}
@@ -189,3 +237,93 @@ func printFields(typ string, fields []quamina.Field, line []byte) {
 	}
 	fmt.Println()
 }
+
+func Test_JX_NestedEarlyExit(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a\nb\nc")
+	paths.Add("x\ny")
+
+	fields, err := NewJxFlattener(paths).Flatten([]byte(`{"a": {"b": {"c": 1}, "zz": 5, "x": {"y": 9}}, "x": {"y": 2}}`), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := `["a\nb\nc"=1 []]["x\ny"=2 []]`
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
+
+func Test_JX_ObjectsInArrays(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a")
+	paths.Add("b")
+
+	fields, err := NewJxFlattener(paths).Flatten([]byte(`{"a": [1, {"x": [1]}, 2], "b": 5}`), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := `["a"=1 [{1 1}]]["a"=2 [{1 3}]]["b"=5 []]`
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	// Objects are traversed against the node of the array, like quamina does, and their
+	// fields carry the array trail.
+	paths.Add("a\nx")
+	paths.Add("c\nd\ne")
+	event := `{"a": [1, {"x": [1], "y": 0}, 2], "b": 5, "c": [{"d": [{"e": 1}, {"e": 2}]}, {"d": {"e": 3}}, "s"]}`
+	fields, err = NewJxFlattener(paths).Flatten([]byte(event), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted = `["a"=1 [{1 1}]]["a"=2 [{1 3}]]["a\nx"=1 [{1 2} {2 1}]]["b"=5 []]` +
+		`["c\nd\ne"=1 [{3 1} {4 1}]]["c\nd\ne"=2 [{3 1} {4 2}]]["c\nd\ne"=3 [{3 2}]]`
+	if got := fieldsSet(fields); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
+
+func Benchmark_JX_ArrayTrails(b *testing.B) {
+	event := []byte(`{ "type": "Feature", "properties": { "STREET": "CRANLEIGH" }, "geometry": { "type": "Polygon", "coordinates": [ [ [ -122.472773074480756, 37.73439178240811, 0.0 ], [ -122.47278111723567, 37.73451247621523, 0.0 ], [ -122.47242608711845, 37.73452184591072, 0.0 ], [ -122.472418368113281, 37.734401143064396, 0.0 ], [ -122.472773074480756, 37.73439178240811, 0.0 ] ] ] } }`)
+
+	paths := NewPaths()
+	paths.Add("properties\nSTREET")
+	paths.Add("geometry\ncoordinates")
+
+	fj := NewJxFlattener(paths)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fj.Flatten(event, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_JX_WideObject(b *testing.B) {
+	// Hundreds of keys, almost none of them indexed.
+	var event strings.Builder
+	event.WriteString(`{"id": "e-1"`)
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&event, `, "attr%d": %d`, i, i)
+	}
+	event.WriteString(`, "detail": {"state": "running"}}`)
+	data := []byte(event.String())
+
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("status")
+	paths.Add("detail\nstate")
+
+	fj := NewJxFlattener(paths)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fj.Flatten(data, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package flattener
+
+// keyFilter is a prefilter of the names of a node, it rejects most keys which aren't in
+// the node before they are hashed for the map lookups. A key passes if its length, its
+// first and its last byte were all seen in one of the names (not necessarily the same).
+//
+//	Wide objects mostly have keys of other lengths and initials, so for them it's three
+//	bit tests instead of two map lookups per key.
+type keyFilter struct {
+	lengths [4]uint64
+	first   [4]uint64
+	last    [4]uint64
+}
+
+func (f *keyFilter) add(name string) {
+	setBit(&f.lengths, keyFilterLength(len(name)))
+	if name != "" {
+		setBit(&f.first, name[0])
+		setBit(&f.last, name[len(name)-1])
+	}
+}
+
+// mayContain returns false when key is certainly not one of the names.
+func (f *keyFilter) mayContain(key []byte) bool {
+	if !hasBit(&f.lengths, keyFilterLength(len(key))) {
+		return false
+	}
+	if len(key) == 0 {
+		return true
+	}
+
+	return hasBit(&f.first, key[0]) && hasBit(&f.last, key[len(key)-1])
+}
+
+// keyFilterLength buckets the lengths, all long names share the last bucket.
+func keyFilterLength(n int) byte {
+	if n > 255 {
+		return 255
+	}
+	return byte(n)
+}
+
+func setBit(bitmap *[4]uint64, b byte) {
+	bitmap[b>>6] |= 1 << (b & 63)
+}
+
+func hasBit(bitmap *[4]uint64, b byte) bool {
+	return bitmap[b>>6]&(1<<(b&63)) != 0
+}
@@ -0,0 +1,41 @@
+package flattener
+
+import (
+	"testing"
+)
+
+func Test_KeyFilter(t *testing.T) {
+	var f keyFilter
+	for _, name := range []string{"id", "STREET", "", string(make([]byte, 300))} {
+		f.add(name)
+	}
+
+	for key, wanted := range map[string]bool{
+		"id":                      true,
+		"STREET":                  true,
+		"":                        true,
+		string(make([]byte, 300)): true,
+		string(make([]byte, 400)): true,
+		"iT":                      true, // A false positive: "i" and "T" ending a name of 2.
+		"ix":                      false,
+		"xd":                      false,
+		"idx":                     false,
+		"SOMETHING_ELSE_ENTIRELY": false,
+		"STREAT":                  true,
+	} {
+		if got := f.mayContain([]byte(key)); got != wanted {
+			t.Errorf("%q: wanted %v got %v", key, wanted, got)
+		}
+	}
+
+	// Nodes and fields added to a PathIndex are added to its filter.
+	paths := NewPaths()
+	paths.Add("a\nb")
+	paths.Add("c")
+	if !paths.settings.keys.mayContain([]byte("a")) || !paths.settings.keys.mayContain([]byte("c")) {
+		t.Error("wanted the root filter to contain a and c")
+	}
+	if paths.settings.keys.mayContain([]byte("b")) {
+		t.Error("wanted the root filter to not contain b")
+	}
+}
@@ -0,0 +1,165 @@
+package flattener
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// WithLenientJSON accepts JSONC / JSON5-like events: comments, trailing commas,
+// single-quoted strings and non-finite numbers (NaN, Infinity, -Infinity).
+//
+//	Events are normalized into standard JSON before flattening, non-finite numbers are
+//	rendered as strings ("NaN") the same way non-finite floats are rendered elsewhere.
+func WithLenientJSON() Option {
+	return func(fj *JxFlattener) {
+		fj.lenient = true
+	}
+}
+
+var nonFiniteNumbers = []string{"NaN", "Infinity", "-Infinity", "+Infinity"}
+
+// AppendNormalizedJSON appends src to dst as standard JSON, dropping comments and trailing
+// commas, and converting single-quoted strings and non-finite numbers. Anything else is
+// copied as is and left for the decoder to validate. It's what WithLenientJSON reads
+// events with.
+//
+//	Whitespace and comments between two tokens are replaced by a single space, so they
+//	still separate them: "1 2" stays invalid instead of becoming 12.
+func AppendNormalizedJSON(dst []byte, src []byte) ([]byte, error) {
+	start := len(dst)
+	pendingComma := false
+	pendingSpace := false
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			pendingSpace = true
+			i++
+			continue
+		case '/':
+			end, err := jsonCommentEnd(src, i)
+			if err != nil {
+				return dst, fmt.Errorf("lenient: %s", err)
+			}
+			pendingSpace = true
+			i = end
+			continue
+		case ',':
+			if pendingComma {
+				return dst, fmt.Errorf("lenient: unexpected ',' at offset %d", i)
+			}
+			pendingComma = true
+			i++
+			continue
+		}
+
+		// A comma is written only once we know it isn't a trailing one.
+		if pendingComma && c != '}' && c != ']' {
+			dst = append(dst, ',')
+		}
+		pendingComma = false
+
+		if pendingSpace && len(dst) > start {
+			dst = append(dst, ' ')
+		}
+		pendingSpace = false
+
+		switch c {
+		case '"':
+			end, err := jsonStringEnd(src, i)
+			if err != nil {
+				return dst, fmt.Errorf("lenient: %s", err)
+			}
+			dst = append(dst, src[i:end]...)
+			i = end
+		case '\'':
+			end, err := jsonQuotedEnd(src, i, '\'')
+			if err != nil {
+				return dst, fmt.Errorf("lenient: %s", err)
+			}
+			dst = appendSingleQuoted(dst, src[i+1:end-1])
+			i = end
+		case 'N', 'I', '-', '+':
+			if word := nonFiniteNumberAt(src, i); word != "" {
+				dst = append(dst, '"')
+				dst = append(dst, bytes.TrimPrefix([]byte(word), []byte("+"))...)
+				dst = append(dst, '"')
+				i += len(word)
+				continue
+			}
+			dst = append(dst, c)
+			i++
+		default:
+			dst = append(dst, c)
+			i++
+		}
+	}
+
+	return dst, nil
+}
+
+// nonFiniteNumberAt returns the non-finite number starting at src[i], or "" when there
+// is none. The word has to end where a value ends, so NaNx isn't read as NaN.
+func nonFiniteNumberAt(src []byte, i int) string {
+	for _, word := range nonFiniteNumbers {
+		if bytes.HasPrefix(src[i:], []byte(word)) && isValueEnd(src, i+len(word)) {
+			return word
+		}
+	}
+	return ""
+}
+
+// isValueEnd reports whether a value may end right before src[i].
+func isValueEnd(src []byte, i int) bool {
+	if i == len(src) {
+		return true
+	}
+	switch src[i] {
+	case ' ', '\t', '\n', '\r', ',', ']', '}', '/':
+		return true
+	}
+	return false
+}
+
+// jsonCommentEnd returns the offset after the // or /* */ comment starting at src[i].
+func jsonCommentEnd(src []byte, i int) (int, error) {
+	if i+1 < len(src) {
+		switch src[i+1] {
+		case '/':
+			if end := bytes.IndexByte(src[i+2:], '\n'); end >= 0 {
+				return i + 2 + end + 1, nil
+			}
+			return len(src), nil
+		case '*':
+			if end := bytes.Index(src[i+2:], []byte("*/")); end >= 0 {
+				return i + 2 + end + 2, nil
+			}
+			return 0, fmt.Errorf("unterminated comment at offset %d", i)
+		}
+	}
+
+	return 0, fmt.Errorf("unexpected '/' at offset %d", i)
+}
+
+// appendSingleQuoted appends the content of a single-quoted string as a double-quoted
+// one, escapes other than \' are kept.
+func appendSingleQuoted(dst []byte, s []byte) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\'':
+			dst = append(dst, '\'')
+			i++
+		case c == '\\' && i+1 < len(s):
+			dst = append(dst, c, s[i+1])
+			i++
+		case c == '"':
+			dst = append(dst, '\\', '"')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,115 @@
+package flattener
+
+import (
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+const lenientEvent = `// sent by a thermostat
+{
+	'device': 'th-1', /* single quotes */
+	"name": 'living "room"',
+	"escaped": 'it\'s é',
+	"temps": [21.5, NaN, -Infinity, +Infinity,],
+	"url": "http://example.com/*not a comment*/",
+	"nested": {"state": "on",},
+}
+`
+
+func Test_Lenient_Flatten(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range []string{"device", "name", "escaped", "temps", "url", "nested\nstate"} {
+		paths.Add(path)
+	}
+
+	if _, err := NewJxFlattener(paths).Flatten([]byte(lenientEvent), nil); err == nil {
+		t.Error("wanted error without the lenient mode")
+	}
+
+	fj := NewJxFlattener(paths, WithLenientJSON())
+	fields, err := fj.Flatten([]byte(lenientEvent), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	temp := func(pos int32) []quamina.ArrayPos {
+		return []quamina.ArrayPos{{Array: 1, Pos: pos}}
+	}
+	wanted := []quamina.Field{
+		{Path: []byte("device"), Val: []byte(`"th-1"`)},
+		{Path: []byte("name"), Val: []byte(`"living \"room\""`)},
+		{Path: []byte("escaped"), Val: []byte(`"it's é"`)},
+		{Path: []byte("temps"), Val: []byte(`21.5`), ArrayTrail: temp(1)},
+		{Path: []byte("temps"), Val: []byte(`"NaN"`), ArrayTrail: temp(2)},
+		{Path: []byte("temps"), Val: []byte(`"-Infinity"`), ArrayTrail: temp(3)},
+		{Path: []byte("temps"), Val: []byte(`"Infinity"`), ArrayTrail: temp(4)},
+		{Path: []byte("url"), Val: []byte(`"http://example.com/*not a comment*/"`)},
+		{Path: []byte("nested\nstate"), Val: []byte(`"on"`)},
+	}
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+
+	// Copies keep the lenient mode.
+	if _, err := fj.Copy().Flatten([]byte(lenientEvent), nil); err != nil {
+		t.Error("Copy: Flatten: " + err.Error())
+	}
+}
+
+func Test_Lenient_FlattenAll(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+
+	input := `[
+		// first
+		{'id': '}'},
+		/* second */ {"id": 2,},
+	]`
+
+	events, err := NewJxFlattener(paths, WithLenientJSON()).FlattenAll([]byte(input))
+	if err != nil {
+		t.Fatal("FlattenAll: " + err.Error())
+	}
+	if len(events) != 2 {
+		t.Fatalf("wanted 2 events, got %d", len(events))
+	}
+	if got := input[events[0].Start:events[0].End]; got != `{'id': '}'}` {
+		t.Errorf("wrong range for the first event: %s", got)
+	}
+	if got, wanted := fieldsSet(events[0].Fields), `["id"="}" []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if got, wanted := fieldsSet(events[1].Fields), `["id"=2 []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	if _, err := NewJxFlattener(paths).FlattenAll([]byte(`[{"id":1},]`)); err == nil {
+		t.Error("wanted error on a trailing comma without the lenient mode")
+	}
+}
+
+func Test_Lenient_Malformed(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a")
+	paths.Add("b")
+
+	fj := NewJxFlattener(paths, WithLenientJSON())
+	for _, input := range []string{
+		`{"a": 1 /* unterminated`,
+		`{"a": 'unterminated}`,
+		`{"a": 1,,}`,
+		`{"a": 1 / 2}`,
+		`{"a": NaNx}`,
+		`{"a": Infinityy}`,
+		`{"a": [-InfinityNaN]}`,
+		`{"a": 1 2}`,
+		`{"a": 1/* comment */2}`,
+		`{"b": tr ue}`,
+		`{"b": "x" "y"}`,
+	} {
+		if _, err := fj.Flatten([]byte(input), nil); err == nil {
+			t.Errorf("%s: wanted error", input)
+		}
+	}
+}
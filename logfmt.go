@@ -0,0 +1,158 @@
+package flattener
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/timbray/quamina"
+)
+
+// LogfmtFlattener flattens logfmt lines (level=error msg="timeout" user.id=42), every
+// line is an event.
+//
+//	Dots in a key nest it, so "user.id" is matched by {"user": {"id": [...]}}. Bare
+//	values are typed as JSON numbers and bools when they look like ones, quoted values
+//	are always strings and a key without a value is true.
+type LogfmtFlattener struct {
+	paths PathIndex
+
+	fields []quamina.Field
+	buf    []byte
+
+	// unquoted holds a quoted value after resolving its escapes.
+	unquoted []byte
+}
+
+// NewLogfmtFlattener creates a flattener for logfmt lines, emitting the fields in paths.
+func NewLogfmtFlattener(paths PathIndex) *LogfmtFlattener {
+	return &LogfmtFlattener{
+		paths:  paths,
+		fields: make([]quamina.Field, 0),
+	}
+}
+
+func (fl *LogfmtFlattener) Copy() quamina.Flattener {
+	return NewLogfmtFlattener(fl.paths)
+}
+
+func (fl *LogfmtFlattener) reset() {
+	fl.fields = fl.fields[:0]
+	fl.buf = fl.buf[:0]
+}
+
+// Flatten flattens a single line.
+func (fl *LogfmtFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	fl.reset()
+
+	i := 0
+	for {
+		for i < len(event) && event[i] <= ' ' {
+			i++
+		}
+		if i == len(event) {
+			return fl.fields, nil
+		}
+
+		start := i
+		for i < len(event) && event[i] > ' ' && event[i] != '=' && event[i] != '"' {
+			i++
+		}
+		if i == start {
+			return fl.fields, fmt.Errorf("logfmt: unexpected %q at offset %d, wanted a key", event[i], i)
+		}
+		key := BinaryString(event[start:i])
+
+		path, indexed := fl.lookup(key)
+
+		if i == len(event) || event[i] != '=' {
+			// A bare key is a flag.
+			if indexed {
+				fl.store(path, []byte("true"), false)
+			}
+			continue
+		}
+		i++
+
+		if i < len(event) && event[i] == '"' {
+			value, next, err := fl.readQuoted(event, i)
+			if err != nil {
+				return fl.fields, err
+			}
+			i = next
+
+			if indexed {
+				fl.store(path, value, true)
+			}
+			continue
+		}
+
+		start = i
+		for i < len(event) && event[i] > ' ' {
+			i++
+		}
+		if indexed {
+			value := event[start:i]
+			fl.store(path, value, !isLogfmtLiteral(BinaryString(value)))
+		}
+	}
+}
+
+func (fl *LogfmtFlattener) lookup(key string) ([]byte, bool) {
+	if strings.IndexByte(key, '.') < 0 {
+		path, ok := fl.paths.getFields()[key]
+		return path, ok
+	}
+
+	return lookupField(fl.paths, strings.Split(key, "."))
+}
+
+// readQuoted reads the quoted value starting at event[i] and returns it without the
+// quotes and escapes, and the offset after it.
+func (fl *LogfmtFlattener) readQuoted(event []byte, i int) ([]byte, int, error) {
+	start := i
+	i++
+
+	fl.unquoted = fl.unquoted[:0]
+	for i < len(event) {
+		c := event[i]
+		switch {
+		case c == '"':
+			return fl.unquoted, i + 1, nil
+		case c == '\\' && i+1 < len(event):
+			i++
+			switch event[i] {
+			case 'n':
+				fl.unquoted = append(fl.unquoted, '\n')
+			case 't':
+				fl.unquoted = append(fl.unquoted, '\t')
+			case 'r':
+				fl.unquoted = append(fl.unquoted, '\r')
+			case '"', '\\':
+				fl.unquoted = append(fl.unquoted, event[i])
+			default:
+				fl.unquoted = append(fl.unquoted, '\\', event[i])
+			}
+		default:
+			fl.unquoted = append(fl.unquoted, c)
+		}
+		i++
+	}
+
+	return nil, 0, fmt.Errorf("logfmt: unterminated quoted value at offset %d", start)
+}
+
+// store appends a field, literal values are used as they are and strings are rendered
+// as JSON strings into the buffer.
+func (fl *LogfmtFlattener) store(path []byte, value []byte, isString bool) {
+	if isString {
+		start := len(fl.buf)
+		fl.buf = appendJSONString(fl.buf, BinaryString(value), false)
+		value = fl.buf[start:len(fl.buf):len(fl.buf)]
+	}
+
+	fl.fields = append(fl.fields, quamina.Field{Path: path, Val: value})
+}
+
+func isLogfmtLiteral(value string) bool {
+	return value == "true" || value == "false" || isJSONNumber(value)
+}
@@ -0,0 +1,79 @@
+package flattener
+
+import (
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+func Test_Logfmt_Flatten(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range []string{"level", "msg", "user\nid", "user\nadmin", "latency", "retry", "path", "empty"} {
+		paths.Add(path)
+	}
+
+	line := `ts=2022-08-01T10:00:00Z level=error msg="timeout after \"3\" tries\n" user.id=42 user.admin=false ` +
+		`user.name=yosi latency=1.5e3 retry path=/v1/orders?id=1 empty= other="x y"`
+
+	fields, err := NewLogfmtFlattener(paths).Flatten([]byte(line), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := []quamina.Field{
+		{Path: []byte("level"), Val: []byte(`"error"`)},
+		{Path: []byte("msg"), Val: []byte(`"timeout after \"3\" tries\n"`)},
+		{Path: []byte("user\nid"), Val: []byte(`42`)},
+		{Path: []byte("user\nadmin"), Val: []byte(`false`)},
+		{Path: []byte("latency"), Val: []byte(`1.5e3`)},
+		{Path: []byte("retry"), Val: []byte(`true`)},
+		{Path: []byte("path"), Val: []byte(`"/v1/orders?id=1"`)},
+		{Path: []byte("empty"), Val: []byte(`""`)},
+	}
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+}
+
+func Test_Logfmt_MatchesJSON(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("level")
+	paths.Add("user\nid")
+
+	q, err := quamina.New(quamina.WithFlattener(NewLogfmtFlattener(paths)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.AddPattern("errors", `{"level": ["error"], "user": {"id": [42]}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	for line, wanted := range map[string]int{
+		`level=error user.id=42`:   1,
+		`level="error" user.id=42`: 1,
+		`level=error user.id="42"`: 0,
+		`level=info user.id=42`:    0,
+	} {
+		matches, err := q.MatchesForEvent([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != wanted {
+			t.Errorf("%s: wanted %d matches, got %v", line, wanted, matches)
+		}
+	}
+}
+
+func Test_Logfmt_Malformed(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("msg")
+
+	fl := NewLogfmtFlattener(paths)
+	if _, err := fl.Flatten([]byte(`msg="unterminated`), nil); err == nil {
+		t.Error("wanted error on unterminated quote")
+	}
+	if _, err := fl.Flatten([]byte(`level=info =value`), nil); err == nil {
+		t.Error("wanted error on missing key")
+	}
+}
@@ -0,0 +1,201 @@
+package flattener
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/timbray/quamina"
+)
+
+// Matcher wraps quamina with the jx flattener, keeping the PathIndex in sync with the
+// patterns so callers never deal with paths.
+//
+//	A Matcher is not safe for concurrent use, use Copy for every goroutine. Copies share
+//	the patterns (like quamina's Copy), patterns added through one of them are matched
+//	by all of them.
+type Matcher struct {
+	q      *quamina.Quamina
+	shared *matcherState
+}
+
+// matcherState is shared by a Matcher and its copies.
+//
+//	The PathIndex is rebuilt lazily, on the first match after the patterns changed, so
+//	adding many patterns doesn't rebuild it for each one.
+type matcherState struct {
+	// version is bumped on every change of the patterns.
+	version uint64
+
+	mu sync.Mutex
+	// patterns holds the paths of the patterns of every X.
+	patterns     map[quamina.X][]string
+	paths        PathIndex
+	pathsVersion uint64
+
+	// encoded holds the encoded JSON documents, they are marked again on every rebuild.
+	encoded []encodedJSON
+
+	// generations holds the generation every X is added to quamina with, see patternX.
+	generations map[quamina.X]uint64
+	generation  uint64
+}
+
+// encodedJSON is the path and settings of an AddEncodedJSON call.
+type encodedJSON struct {
+	path           string
+	maxDecodedSize int
+	steps          []DecodeStep
+}
+
+// patternX is the X patterns are added to quamina with.
+//
+//	quamina's pattern deletion only filters out the matches of deleted Xs, their patterns
+//	stay in the automaton until it's rebuilt. Adding patterns with a deleted X again
+//	would revive its old patterns, so the X gets a new generation after every delete.
+type patternX struct {
+	x          quamina.X
+	generation uint64
+}
+
+// NewMatcher creates a Matcher, opts configure its flatteners.
+func NewMatcher(opts ...Option) (*Matcher, error) {
+	shared := &matcherState{patterns: make(map[quamina.X][]string), paths: NewPaths(), generations: make(map[quamina.X]uint64)}
+
+	q, err := quamina.New(quamina.WithFlattener(&matcherFlattener{shared: shared, opts: opts}), quamina.WithPatternDeletion(true))
+	if err != nil {
+		return nil, fmt.Errorf("NewMatcher: %s", err)
+	}
+
+	return &Matcher{q: q, shared: shared}, nil
+}
+
+func (m *Matcher) AddPattern(x quamina.X, pattern string) error {
+	paths, err := PatternPaths([]byte(pattern))
+	if err != nil {
+		return fmt.Errorf("AddPattern: %s", err)
+	}
+
+	m.shared.mu.Lock()
+	defer m.shared.mu.Unlock()
+
+	generation, ok := m.shared.generations[x]
+	if !ok {
+		generation = m.shared.generation + 1
+	}
+	if err := m.q.AddPattern(patternX{x: x, generation: generation}, pattern); err != nil {
+		return err
+	}
+	if !ok {
+		m.shared.generation = generation
+		m.shared.generations[x] = generation
+	}
+	m.shared.patterns[x] = append(m.shared.patterns[x], paths...)
+
+	atomic.AddUint64(&m.shared.version, 1)
+	return nil
+}
+
+// DeletePattern deletes all the patterns added with x, patterns added with x afterwards
+// are matched on their own.
+func (m *Matcher) DeletePattern(x quamina.X) error {
+	m.shared.mu.Lock()
+	defer m.shared.mu.Unlock()
+
+	generation, ok := m.shared.generations[x]
+	if !ok {
+		return nil
+	}
+	if err := m.q.DeletePatterns(patternX{x: x, generation: generation}); err != nil {
+		return err
+	}
+	delete(m.shared.generations, x)
+	delete(m.shared.patterns, x)
+
+	atomic.AddUint64(&m.shared.version, 1)
+	return nil
+}
+
+// AddEmbeddedJSON marks path as holding a JSON document encoded as a string, see
+// PathIndex.AddEmbeddedJSON. It applies to the patterns added before and after it.
+func (m *Matcher) AddEmbeddedJSON(path string) {
+	m.AddEncodedJSON(path, 0)
+}
+
+// AddEncodedJSON marks path as holding an encoded JSON document, see
+// PathIndex.AddEncodedJSON. It applies to the patterns added before and after it.
+func (m *Matcher) AddEncodedJSON(path string, maxDecodedSize int, steps ...DecodeStep) {
+	m.shared.mu.Lock()
+	defer m.shared.mu.Unlock()
+
+	m.shared.encoded = append(m.shared.encoded, encodedJSON{path: path, maxDecodedSize: maxDecodedSize, steps: steps})
+	atomic.AddUint64(&m.shared.version, 1)
+}
+
+// MatchesForEvent returns the patterns matching a JSON event.
+func (m *Matcher) MatchesForEvent(event []byte) ([]quamina.X, error) {
+	matches, err := m.q.MatchesForEvent(event)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, match := range matches {
+		matches[i] = match.(patternX).x
+	}
+	return matches, nil
+}
+
+// Copy returns a Matcher sharing the patterns, for use in another goroutine.
+func (m *Matcher) Copy() *Matcher {
+	return &Matcher{q: m.q.Copy(), shared: m.shared}
+}
+
+// matcherFlattener is the flattener of the quamina of a Matcher, it flattens with the
+// PathIndex of the current patterns.
+type matcherFlattener struct {
+	shared *matcherState
+	opts   []Option
+
+	// fj is built for version of the patterns, and rebuilt once they change.
+	fj      *JxFlattener
+	version uint64
+}
+
+func (f *matcherFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	if version := atomic.LoadUint64(&f.shared.version); f.fj == nil || version != f.version {
+		paths, pathsVersion := f.shared.index()
+		f.fj = NewJxFlattener(paths, f.opts...)
+		f.version = pathsVersion
+	}
+
+	return f.fj.Flatten(event, tracker)
+}
+
+// Copy returns a flattener for a copy of the quamina, it builds its own JxFlattener.
+func (f *matcherFlattener) Copy() quamina.Flattener {
+	return &matcherFlattener{shared: f.shared, opts: f.opts}
+}
+
+// index returns the PathIndex of the current patterns and their version, building it
+// when they changed. The PathIndex is never modified after it's returned, since copies
+// flatten with it concurrently.
+func (s *matcherState) index() (PathIndex, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version := atomic.LoadUint64(&s.version); s.pathsVersion != version {
+		paths := NewPaths()
+		for _, xPaths := range s.patterns {
+			for _, path := range xPaths {
+				paths.Add(path)
+			}
+		}
+		for _, e := range s.encoded {
+			paths.AddEncodedJSON(e.path, e.maxDecodedSize, e.steps...)
+		}
+
+		s.paths, s.pathsVersion = paths, version
+	}
+
+	return s.paths, s.pathsVersion
+}
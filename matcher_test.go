@@ -0,0 +1,232 @@
+package flattener
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+func Test_Matcher_Patterns(t *testing.T) {
+	m, err := NewMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := []byte(`{"type": "Feature", "properties": {"STREET": "CRANLEIGH", "BLOCK_NUM": "7222"}, "geometry": {"coordinates": [1, 2]}}`)
+	match := func() string {
+		matches, err := m.MatchesForEvent(event)
+		if err != nil {
+			t.Fatal("MatchesForEvent: " + err.Error())
+		}
+		return matchesString(matches)
+	}
+
+	if got := match(); got != "[]" {
+		t.Errorf("wanted no matches, got %s", got)
+	}
+
+	// Paths of patterns added after matching are picked up.
+	if err := m.AddPattern("street", `{"properties": {"STREET": ["CRANLEIGH"]}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddPattern("coordinates", `{"geometry": {"coordinates": [2]}}`); err != nil {
+		t.Fatal(err)
+	}
+	if got, wanted := match(), "[coordinates street]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	if err := m.DeletePattern("street"); err != nil {
+		t.Fatal(err)
+	}
+	if got, wanted := match(), "[coordinates]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	if err := m.AddPattern("bad", `{"properties": `); err == nil {
+		t.Error("wanted error for an invalid pattern")
+	}
+	if _, err := m.MatchesForEvent([]byte(`[1, 2]`)); err == nil {
+		t.Error("wanted error for an invalid event")
+	}
+}
+
+func Test_Matcher_MatchesLikeQuamina(t *testing.T) {
+	patterns := map[quamina.X]string{
+		"sku":    `{"items": {"sku": ["x"]}}`,
+		"nested": `{"items": {"parts": {"id": [2]}}}`,
+		"both":   `{"items": {"sku": ["y"], "qty": [3]}}`,
+		"scalar": `{"items": ["plain"]}`,
+	}
+	events := []string{
+		`{"items":[{"sku":"x"}]}`,
+		`{"items":["plain", {"sku":"z"}, [{"parts": [{"id": 1}, {"id": 2}]}]]}`,
+		`{"items":[{"sku":"y", "qty": 1}, {"sku":"x", "qty": 3}]}`,
+		`{"items":[{"sku":"y", "qty": 3}], "other": {"sku": "x"}}`,
+		`{"items":{"sku":"x"}}`,
+	}
+
+	m, err := NewMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := quamina.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x, pattern := range patterns {
+		if err := m.AddPattern(x, pattern); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.AddPattern(x, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, event := range events {
+		got, err := m.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal("MatchesForEvent: " + err.Error())
+		}
+		wanted, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal("quamina: MatchesForEvent: " + err.Error())
+		}
+		if matchesString(got) != matchesString(wanted) {
+			t.Errorf("%s: wanted %s got %s", event, matchesString(wanted), matchesString(got))
+		}
+	}
+}
+
+func Test_Matcher_ReplacePattern(t *testing.T) {
+	m, err := NewMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cranleigh := []byte(`{"properties": {"STREET": "CRANLEIGH"}}`)
+	beach := []byte(`{"properties": {"STREET": "BEACH"}}`)
+	match := func(event []byte) string {
+		matches, err := m.MatchesForEvent(event)
+		if err != nil {
+			t.Fatal("MatchesForEvent: " + err.Error())
+		}
+		return matchesString(matches)
+	}
+
+	if err := m.AddPattern("p", `{"properties": {"STREET": ["CRANLEIGH"]}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeletePattern("p"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddPattern("p", `{"properties": {"STREET": ["BEACH"]}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted pattern isn't revived by adding another one with the same X.
+	if got := match(cranleigh); got != "[]" {
+		t.Errorf("wanted no matches, got %s", got)
+	}
+	if got, wanted := match(beach), "[p]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	if err := m.DeletePattern("missing"); err != nil {
+		t.Error("DeletePattern: " + err.Error())
+	}
+}
+
+func Test_Matcher_EmbeddedJSON(t *testing.T) {
+	m, err := NewMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AddEmbeddedJSON("Message")
+
+	if err := m.AddPattern("gold", `{"Message": {"customer": {"tier": ["gold"]}}}`); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := m.MatchesForEvent([]byte(snsNotification))
+	if err != nil {
+		t.Fatal("MatchesForEvent: " + err.Error())
+	}
+	if got, wanted := matchesString(matches), "[gold]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	// The documents are still decoded once the PathIndex is rebuilt for new patterns.
+	if err := m.AddPattern("order", `{"Message": {"orderId": ["o-17"]}}`); err != nil {
+		t.Fatal(err)
+	}
+	matches, err = m.MatchesForEvent([]byte(snsNotification))
+	if err != nil {
+		t.Fatal("MatchesForEvent: " + err.Error())
+	}
+	if got, wanted := matchesString(matches), "[gold order]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
+
+func Test_Matcher_EncodedJSON(t *testing.T) {
+	m, err := NewMatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AddEncodedJSON("data", 0, DecodeBase64)
+
+	if err := m.AddPattern("one", `{"data": {"a": [1]}}`); err != nil {
+		t.Fatal(err)
+	}
+	event := []byte(`{"data": "` + base64.StdEncoding.EncodeToString([]byte(`{"a": 1}`)) + `"}`)
+	matches, err := m.MatchesForEvent(event)
+	if err != nil {
+		t.Fatal("MatchesForEvent: " + err.Error())
+	}
+	if got, wanted := matchesString(matches), "[one]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
+
+func Test_Matcher_Copies(t *testing.T) {
+	m, err := NewMatcher(WithStructuralIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddPattern("p0", `{"n": [0]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies match concurrently while patterns are added.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(c *Matcher) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if _, err := c.MatchesForEvent([]byte(fmt.Sprintf(`{"n": %d, "f%d": 1}`, i%3, i%3))); err != nil {
+					t.Error("MatchesForEvent: " + err.Error())
+				}
+			}
+		}(m.Copy())
+	}
+	for i := 1; i < 3; i++ {
+		if err := m.AddPattern(fmt.Sprintf("p%d", i), fmt.Sprintf(`{"f%d": [1]}`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	// Once done, every copy sees all the patterns.
+	c := m.Copy()
+	matches, err := c.MatchesForEvent([]byte(`{"n": 0, "f2": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, wanted := matchesString(matches), "[p0 p2]"; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+}
@@ -0,0 +1,101 @@
+package flattener
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics observes the events flattened by a JxFlattener, see WithMetrics.
+//
+//	ObserveEvent is called once per event, from every copy of the flattener, so it has
+//	to be safe for concurrent use.
+type Metrics interface {
+	ObserveEvent(e EventMetrics)
+}
+
+// EventMetrics are the counts of a single flattened event.
+type EventMetrics struct {
+	// Bytes is the size of the event, SkippedBytes the size of the values which were
+	// skipped without being parsed (not counted with json-iterator).
+	Bytes        int
+	SkippedBytes int
+
+	Fields int
+
+	// EarlyExit is set when the event wasn't parsed till its end, since all the paths
+	// were found.
+	EarlyExit bool
+
+	// ErrorKind is the kind of error the event failed with, empty when it didn't.
+	ErrorKind string
+
+	Duration time.Duration
+}
+
+// The kinds of errors reported in EventMetrics.
+const (
+	ErrorKindSyntax   = "syntax"
+	ErrorKindEmbedded = "embedded"
+	ErrorKindLenient  = "lenient"
+)
+
+// WithMetrics reports every flattened event to m. Without it nothing is measured.
+func WithMetrics(m Metrics) Option {
+	return func(fj *JxFlattener) {
+		fj.metrics = m
+	}
+}
+
+// eventStats are collected while flattening an event, they are only reported when
+// metrics are enabled.
+type eventStats struct {
+	skippedBytes int
+	fields       int
+	earlyExit    bool
+	errorKind    string
+}
+
+func (fj *JxFlattener) observeEvent(event []byte) error {
+	fj.stats = eventStats{}
+
+	start := time.Now()
+	err := fj.parseEvent(event)
+	duration := time.Since(start)
+
+	e := EventMetrics{
+		Bytes:        len(event),
+		SkippedBytes: fj.stats.skippedBytes,
+		Fields:       fj.stats.fields,
+		EarlyExit:    fj.stats.earlyExit,
+		Duration:     duration,
+	}
+	if err != nil && !errors.Is(err, errStopFlattening) {
+		e.ErrorKind = fj.stats.errorKind
+		if e.ErrorKind == "" {
+			e.ErrorKind = ErrorKindSyntax
+		}
+	}
+
+	fj.metrics.ObserveEvent(e)
+	return err
+}
+
+// skipMeasurer is implemented by the tokenizers which can tell the length of a skipped
+// value from their offsets around Skip, at no cost over it. The others (json-iterator
+// and custom tokenizers) report no skipped bytes, rather than copying the values.
+type skipMeasurer interface {
+	skipMeasured() (int, error)
+}
+
+// skip skips the current value, counting its bytes when metrics are enabled.
+func (fj *JxFlattener) skip() error {
+	if fj.metrics != nil {
+		if m, ok := fj.tok.(skipMeasurer); ok {
+			n, err := m.skipMeasured()
+			fj.stats.skippedBytes += n
+			return err
+		}
+	}
+
+	return fj.tok.Skip()
+}
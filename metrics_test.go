@@ -0,0 +1,172 @@
+package flattener
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+// recordingMetrics keeps the observed events.
+type recordingMetrics struct {
+	mu     sync.Mutex
+	events []EventMetrics
+}
+
+func (r *recordingMetrics) ObserveEvent(e EventMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordingMetrics) last(t *testing.T) EventMetrics {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) == 0 {
+		t.Fatal("no events observed")
+	}
+	return r.events[len(r.events)-1]
+}
+
+func Test_Metrics_Counts(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a\nb")
+	paths.Add("c")
+
+	rec := &recordingMetrics{}
+	fj := NewJxFlattener(paths, WithMetrics(rec))
+
+	// Everything but the paths is skipped: "skip", "a"'s "z" and "d".
+	event := `{"skip": [1, 2], "a": {"z": "xyz", "b": 1}, "c": [3, 4], "d": {"e": 5}}`
+	if _, err := fj.Flatten([]byte(event), nil); err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	e := rec.last(t)
+	if e.Bytes != len(event) || e.SkippedBytes != len(`[1, 2]`)+len(`"xyz"`)+len(`{"e": 5}`) || e.Fields != 3 || e.ErrorKind != "" {
+		t.Errorf("unexpected metrics %+v", e)
+	}
+	if e.EarlyExit || e.Duration <= 0 {
+		t.Errorf("wanted no early exit and a duration, got %+v", e)
+	}
+
+	// Once the nodes are done, the rest of the event isn't parsed.
+	paths = NewPaths()
+	paths.Add("a\nb")
+	fj = NewJxFlattener(paths, WithMetrics(rec)).Copy().(*JxFlattener)
+	if _, err := fj.Flatten([]byte(`{"a": {"b": 1}, "c": 2}`), nil); err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	if e := rec.last(t); !e.EarlyExit || e.Fields != 1 {
+		t.Errorf("wanted an early exit, got %+v", e)
+	}
+
+	// Stopping FlattenFunc isn't an error.
+	if err := fj.FlattenFunc([]byte(`{"a": {"b": 1}}`), func(quamina.Field) bool { return false }); err != nil {
+		t.Fatal("FlattenFunc: " + err.Error())
+	}
+	if e := rec.last(t); e.ErrorKind != "" {
+		t.Errorf("wanted no error, got %+v", e)
+	}
+
+	// FlattenAll observes every event.
+	before := len(rec.events)
+	if _, err := fj.FlattenAll([]byte(`{"a": {"b": 1}} {"a": {"b": 2}}`)); err != nil {
+		t.Fatal("FlattenAll: " + err.Error())
+	}
+	if got := len(rec.events) - before; got != 2 {
+		t.Errorf("wanted 2 events observed, got %d", got)
+	}
+}
+
+func Test_Metrics_ErrorKinds(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a")
+	paths.Add("payload\nkind")
+	paths.AddEncodedJSON("payload", 0, DecodeBase64)
+
+	rec := &recordingMetrics{}
+	for _, c := range []struct {
+		event string
+		opts  []Option
+		kind  string
+	}{
+		{`[1]`, nil, ErrorKindSyntax},
+		{`{"x": 1 "a": 2}`, nil, ErrorKindSyntax},
+		{`{"payload": "not base64!"}`, nil, ErrorKindEmbedded},
+		{`{"a": 1 /* unterminated`, []Option{WithLenientJSON()}, ErrorKindLenient},
+	} {
+		fj := NewJxFlattener(paths, append(c.opts, WithMetrics(rec))...)
+		if _, err := fj.Flatten([]byte(c.event), nil); err == nil {
+			t.Errorf("%s: wanted error", c.event)
+			continue
+		}
+		if e := rec.last(t); e.ErrorKind != c.kind {
+			t.Errorf("%s: wanted error kind %s got %q", c.event, c.kind, e.ErrorKind)
+		}
+	}
+}
+
+func Test_Metrics_DontChangeResults(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a")
+
+	// The skipped string holds a raw tab, the structural tokenizer only rejects it in
+	// the values it parses.
+	events := []string{
+		"{\"skip\": \"x\ty\", \"big\": {\"x\": [1, 2, 3]}, \"a\": 1}",
+		`{"skip": [1, 2, 3], "a": 1`,
+	}
+
+	for name, newTokenizer := range map[string]func() Tokenizer{
+		"jx":         NewJxTokenizer,
+		"structural": NewStructuralTokenizer,
+		"jsoniter":   NewJsoniterTokenizer,
+	} {
+		plain := NewJxFlattener(paths, WithTokenizer(newTokenizer))
+		measured := NewJxFlattener(paths, WithTokenizer(newTokenizer), WithMetrics(&recordingMetrics{}))
+
+		for _, event := range events {
+			wanted, wantedErr := plain.Flatten([]byte(event), nil)
+			got, err := measured.Flatten([]byte(event), nil)
+			if fmt.Sprint(wantedErr) != fmt.Sprint(err) || !reflect.DeepEqual(wanted, got) {
+				t.Errorf("%s: %s: wanted %v, %v got %v, %v", name, event, wanted, wantedErr, got, err)
+			}
+
+			plainAllocs := testing.AllocsPerRun(100, func() { _, _ = plain.Flatten([]byte(event), nil) })
+			measuredAllocs := testing.AllocsPerRun(100, func() { _, _ = measured.Flatten([]byte(event), nil) })
+			if err == nil && plainAllocs != measuredAllocs {
+				t.Errorf("%s: %s: wanted %v allocations with metrics, got %v", name, event, plainAllocs, measuredAllocs)
+			}
+		}
+	}
+}
+
+func Benchmark_JX_Metrics(b *testing.B) {
+	paths := NewPaths()
+	paths.Add("a\nb")
+	paths.Add("c")
+	event := []byte(`{"skip": [1, 2], "a": {"z": "xyz", "b": 1}, "c": [3, 4], "d": {"e": 5}}`)
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"disabled", nil},
+		{"prometheus", []Option{WithMetrics(NewPrometheusMetrics("flattener"))}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fj := NewJxFlattener(paths, bc.opts...)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := fj.Flatten(event, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package flattener
 
 import (
 	"strings"
@@ -14,6 +14,9 @@ type Node interface {
 
 	getOrCreate(name string) Node
 	addField(name string, path []byte)
+
+	isEmbeddedJSON() bool
+	getSettings() *nodeSettings
 }
 
 type PathIndex struct {
@@ -22,28 +25,94 @@ type PathIndex struct {
 	// fields map from it's name to it's full path (as specific in quamina.Field)
 	// will be present only on the leafs
 	fields map[string][]byte
+
+	// settings are set through the index (which is passed around by value),
+	// so they are kept behind a pointer.
+	settings *nodeSettings
+}
+
+type nodeSettings struct {
+	// embeddedJSON marks a node whose value is a JSON document encoded as a string.
+	embeddedJSON bool
+
+	// decodeSteps are applied, in order, on the string of an embedded document before
+	// parsing it as JSON. The size of every decoded step is limited by maxDecodedSize.
+	decodeSteps    []DecodeStep
+	maxDecodedSize int
+
+	// keys is a prefilter of the node's nodes and fields names, added counts them so
+	// the shape cache learns the node again once it changes.
+	keys  keyFilter
+	added int
 }
 
-func newPaths() PathIndex {
+// DecodeStep is a decoding applied on an encoded JSON document, see AddEncodedJSON.
+type DecodeStep int
+
+const (
+	// DecodeBase64 decodes standard base64, padded or not.
+	DecodeBase64 DecodeStep = iota
+	// DecodeGzip gunzips.
+	DecodeGzip
+)
+
+// defaultMaxDecodedSize limits decoded values when no limit is given, so a small
+// compressed value can't expand into gigabytes.
+const defaultMaxDecodedSize = 4 * 1024 * 1024
+
+// NewPaths creates an empty PathIndex.
+func NewPaths() PathIndex {
 	return PathIndex{
-		nodes:  make(map[string]Node),
-		fields: make(map[string][]byte),
+		nodes:    make(map[string]Node),
+		fields:   make(map[string][]byte),
+		settings: &nodeSettings{},
 	}
 }
 
-func (p PathIndex) add(path string) {
+// Add adds the path of a field, its segments are separated by PATH_SEPARATOR.
+func (p PathIndex) Add(path string) {
 	parts := strings.Split(path, PATH_SEPARATOR)
+	last := len(parts) - 1
 
 	var node Node
-	node = p.getOrCreate(parts[0])
+	node = p
 
-	for i, part := range parts[1:] {
-		if i == len(parts)-2 {
-			node.addField(part, []byte(path))
-		} else {
-			node = node.getOrCreate(part)
-		}
+	for _, part := range parts[:last] {
+		node = node.getOrCreate(part)
 	}
+
+	// Top-level paths (no separator) are fields of the root node.
+	node.addField(parts[last], []byte(path))
+}
+
+// AddEmbeddedJSON marks the node at path as holding a JSON document encoded as a string
+// (like the "Message" of an SNS notification), the flattener decodes the string and
+// continues traversing into it.
+func (p PathIndex) AddEmbeddedJSON(path string) {
+	p.AddEncodedJSON(path, 0)
+}
+
+// AddEncodedJSON marks the node at path as holding an encoded JSON document, like
+// the base64 encoded and gzipped "data" of a Kinesis record. The steps are applied
+// in order and then the result is parsed as JSON.
+//
+//	maxDecodedSize limits the size of every step's output, 0 uses defaultMaxDecodedSize.
+func (p PathIndex) AddEncodedJSON(path string, maxDecodedSize int, steps ...DecodeStep) {
+	var node Node
+	node = p
+
+	for _, part := range strings.Split(path, PATH_SEPARATOR) {
+		node = node.getOrCreate(part)
+	}
+
+	if maxDecodedSize <= 0 {
+		maxDecodedSize = defaultMaxDecodedSize
+	}
+
+	settings := node.getSettings()
+	settings.embeddedJSON = true
+	settings.decodeSteps = steps
+	settings.maxDecodedSize = maxDecodedSize
 }
 
 func (p PathIndex) get(name string) (Node, bool) {
@@ -53,7 +122,9 @@ func (p PathIndex) get(name string) (Node, bool) {
 
 func (p PathIndex) getOrCreate(name string) Node {
 	if _, ok := p.nodes[name]; !ok {
-		p.nodes[name] = newPaths()
+		p.nodes[name] = NewPaths()
+		p.settings.keys.add(name)
+		p.settings.added++
 	}
 
 	return p.nodes[name]
@@ -62,6 +133,8 @@ func (p PathIndex) getOrCreate(name string) Node {
 func (p PathIndex) addField(name string, path []byte) {
 	if _, ok := p.fields[name]; !ok {
 		p.fields[name] = path
+		p.settings.keys.add(name)
+		p.settings.added++
 	}
 }
 
@@ -73,6 +146,14 @@ func (p PathIndex) nodesCount() int {
 	return len(p.nodes)
 }
 
+func (p PathIndex) isEmbeddedJSON() bool {
+	return p.settings.embeddedJSON
+}
+
+func (p PathIndex) getSettings() *nodeSettings {
+	return p.settings
+}
+
 func (p PathIndex) names() []string {
 	na := make([]string, 0)
 
@@ -82,3 +163,16 @@ func (p PathIndex) names() []string {
 	return na
 
 }
+
+// lookupField finds a field by its path segments, returning its full path.
+func lookupField(n Node, parts []string) ([]byte, bool) {
+	for _, part := range parts[:len(parts)-1] {
+		var ok bool
+		if n, ok = n.get(part); !ok {
+			return nil, false
+		}
+	}
+
+	path, ok := n.getFields()[parts[len(parts)-1]]
+	return path, ok
+}
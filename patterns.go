@@ -0,0 +1,61 @@
+package flattener
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-faster/jx"
+)
+
+// AddPattern adds the paths a quamina pattern matches on.
+func (p PathIndex) AddPattern(pattern string) error {
+	paths, err := PatternPaths([]byte(pattern))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		p.Add(path)
+	}
+	return nil
+}
+
+// PatternPaths returns the paths of the fields a quamina pattern matches on, so the
+// PathIndex can be built without asking quamina for them.
+//
+//	A pattern is an object whose values are either nested objects or arrays of values to
+//	match. The arrays are the leaves, whatever they hold - values or operators like
+//	{"exists": true}, {"shellstyle": "a*"} or {"anything-but": [..]} - they match on
+//	the path leading to them.
+func PatternPaths(pattern []byte) ([]string, error) {
+	d := jx.DecodeBytes(pattern)
+	if d.Next() != jx.Object {
+		return nil, fmt.Errorf("PatternPaths: pattern must be an object")
+	}
+
+	var paths []string
+	if err := appendPatternPaths(d, nil, &paths); err != nil {
+		return nil, fmt.Errorf("PatternPaths: %s", err)
+	}
+	if d.Next() != jx.Invalid {
+		return nil, fmt.Errorf("PatternPaths: unexpected data after the pattern")
+	}
+
+	return paths, nil
+}
+
+func appendPatternPaths(d *jx.Decoder, parents []string, paths *[]string) error {
+	return d.ObjBytes(func(d *jx.Decoder, key []byte) error {
+		names := append(parents[:len(parents):len(parents)], string(key))
+
+		switch typ := d.Next(); typ {
+		case jx.Object:
+			return appendPatternPaths(d, names, paths)
+		case jx.Array:
+			*paths = append(*paths, strings.Join(names, PATH_SEPARATOR))
+			return d.Skip()
+		default:
+			return fmt.Errorf("value of %q must be an object or an array, got %s", key, typ)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package flattener
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_PatternPaths(t *testing.T) {
+	cases := []struct {
+		pattern string
+		paths   []string
+	}{
+		{`{"a": [1]}`, []string{"a"}},
+		{`{"a": {"b": ["x"], "c": {"d": [true]}}, "e": [null]}`, []string{"a\nb", "a\nc\nd", "e"}},
+		{`{"a": [{"exists": true}], "b": [{"exists": false}]}`, []string{"a", "b"}},
+		{`{"properties": {"STREET": [{"shellstyle": "N*P*"}]}}`, []string{"properties\nSTREET"}},
+		{`{"a": [{"anything-but": ["x", "y"]}], "b": [{"prefix": "p"}, "q"]}`, []string{"a", "b"}},
+		{`{"a": {"b": [{"numeric": [">", 0]}]}}`, []string{"a\nb"}},
+		{`{"a\"b": {"c": [1]}}`, []string{"a\"b\nc"}},
+		{`{}`, nil},
+	}
+
+	for _, c := range cases {
+		paths, err := PatternPaths([]byte(c.pattern))
+		if err != nil {
+			t.Errorf("%s: %s", c.pattern, err)
+			continue
+		}
+
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.paths) {
+			t.Errorf("%s: wanted %q got %q", c.pattern, c.paths, paths)
+		}
+	}
+
+	for _, pattern := range []string{``, `[1]`, `{"a": 1}`, `{"a": "x"}`, `{"a": [1]`, `{"a": [1]} {}`} {
+		if _, err := PatternPaths([]byte(pattern)); err == nil {
+			t.Errorf("%s: wanted error", pattern)
+		}
+	}
+}
+
+func Test_PathIndex_AddPattern(t *testing.T) {
+	paths := NewPaths()
+	if err := paths.AddPattern(`{"properties": {"STREET": ["CRANLEIGH"]}, "geometry": {"coordinates": [2]}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"properties\nSTREET", "geometry\ncoordinates"} {
+		if _, ok := lookupField(paths, strings.Split(path, PATH_SEPARATOR)); !ok {
+			t.Errorf("missing %q", path)
+		}
+	}
+	if err := paths.AddPattern(`{"properties": 1}`); err == nil {
+		t.Error("wanted error for an invalid pattern")
+	}
+}
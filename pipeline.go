@@ -0,0 +1,189 @@
+package flattener
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/timbray/quamina"
+)
+
+// PipelineResult is the outcome of flattening and matching a single event, Seq is the
+// position of the event in the input.
+type PipelineResult struct {
+	Seq     int
+	Event   []byte
+	Matches []quamina.X
+	Err     error
+}
+
+// ErrPipelineClosed is returned by Submit once the Pipeline is closed.
+var ErrPipelineClosed = errors.New("pipeline: closed")
+
+// Pipeline fans events out to workers which flatten and match them in parallel, every
+// worker holds its own copy of the quamina (and so of its flattener).
+//
+//	Backpressure: at most window events are in flight (submitted and not yet read from
+//	Results), so Submit blocks while the reader of Results lags behind. With ordered
+//	results, this also bounds the events waiting for a slower one before them.
+//
+//	Shutdown: Close ends the input, Results is closed once the results of all submitted
+//	events were read. Cancelling the context stops the workers and drops the events in
+//	flight.
+type Pipeline struct {
+	ctx     context.Context
+	ordered bool
+
+	events  chan pipelineEvent
+	done    chan PipelineResult
+	results chan PipelineResult
+
+	// slots holds a token for every event in flight.
+	slots chan struct{}
+
+	seq    int
+	closed bool
+}
+
+type pipelineEvent struct {
+	seq   int
+	event []byte
+}
+
+// NewPipeline starts a pipeline with workers workers matching with q, which is usually
+// created with quamina.WithFlattener. ordered delivers the results in the order the
+// events were submitted.
+func NewPipeline(ctx context.Context, q *quamina.Quamina, workers int, ordered bool) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	window := workers * 4
+
+	p := &Pipeline{
+		ctx:     ctx,
+		ordered: ordered,
+		events:  make(chan pipelineEvent, workers),
+		done:    make(chan PipelineResult, workers),
+		results: make(chan PipelineResult),
+		slots:   make(chan struct{}, window),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(q *quamina.Quamina) {
+			defer wg.Done()
+			p.work(q)
+		}(q.Copy())
+	}
+	go func() {
+		wg.Wait()
+		close(p.done)
+	}()
+
+	go p.deliver()
+
+	return p
+}
+
+// Submit queues an event, blocking while the pipeline is full. It must not be called
+// concurrently, neither with Close.
+func (p *Pipeline) Submit(event []byte) error {
+	if p.closed {
+		return ErrPipelineClosed
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+
+	select {
+	case p.events <- pipelineEvent{seq: p.seq, event: event}:
+		p.seq++
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Close ends the input, the workers finish the submitted events and exit.
+func (p *Pipeline) Close() {
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+	}
+}
+
+// Results returns the results channel, it's closed once all the results were read or the
+// context is cancelled.
+func (p *Pipeline) Results() <-chan PipelineResult {
+	return p.results
+}
+
+func (p *Pipeline) work(q *quamina.Quamina) {
+	for {
+		var e pipelineEvent
+		var ok bool
+
+		select {
+		case e, ok = <-p.events:
+			if !ok {
+				return
+			}
+		case <-p.ctx.Done():
+			return
+		}
+
+		r := PipelineResult{Seq: e.seq, Event: e.event}
+		r.Matches, r.Err = q.MatchesForEvent(e.event)
+
+		select {
+		case p.done <- r:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver passes the results of the workers to Results, reordering them when needed.
+func (p *Pipeline) deliver() {
+	defer close(p.results)
+
+	pending := make(map[int]PipelineResult)
+	next := 0
+
+	for r := range p.done {
+		if !p.ordered {
+			if !p.send(r) {
+				return
+			}
+			continue
+		}
+
+		pending[r.Seq] = r
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			if !p.send(r) {
+				return
+			}
+		}
+	}
+}
+
+func (p *Pipeline) send(r PipelineResult) bool {
+	select {
+	case p.results <- r:
+		<-p.slots
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
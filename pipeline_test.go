@@ -0,0 +1,149 @@
+package flattener
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/timbray/quamina"
+)
+
+func newPipelineMatcher(t *testing.T) *quamina.Quamina {
+	patterns := []struct{ x, pattern string }{
+		{"even", `{"kind": ["even"]}`},
+		{"small", `{"size": {"bucket": ["small"]}}`},
+	}
+
+	paths := NewPaths()
+	for _, p := range patterns {
+		if err := paths.AddPattern(p.pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := quamina.New(quamina.WithFlattener(NewJxFlattener(paths)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range patterns {
+		if err := q.AddPattern(p.x, p.pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return q
+}
+
+func pipelineEvents(n int) [][]byte {
+	events := make([][]byte, n)
+	for i := range events {
+		kind, bucket := "odd", "large"
+		if i%2 == 0 {
+			kind = "even"
+		}
+		if i%3 == 0 {
+			bucket = "small"
+		}
+		events[i] = []byte(fmt.Sprintf(`{"id": %d, "kind": "%s", "size": {"bucket": "%s"}}`, i, kind, bucket))
+	}
+	return events
+}
+
+func matchesString(matches []quamina.X) string {
+	s := make([]string, 0, len(matches))
+	for _, m := range matches {
+		s = append(s, m.(string))
+	}
+	sort.Strings(s)
+	return fmt.Sprint(s)
+}
+
+func Test_Pipeline_Results(t *testing.T) {
+	q := newPipelineMatcher(t)
+	events := pipelineEvents(1000)
+	events[500] = []byte(`{"kind": `)
+
+	// The serial results to compare with.
+	wanted := make([]string, len(events))
+	for i, event := range events {
+		matches, err := q.MatchesForEvent(event)
+		if err != nil {
+			wanted[i] = "error"
+			continue
+		}
+		wanted[i] = matchesString(matches)
+	}
+
+	for _, ordered := range []bool{true, false} {
+		p := NewPipeline(context.Background(), q, runtime.NumCPU(), ordered)
+		go func() {
+			for _, event := range events {
+				if err := p.Submit(event); err != nil {
+					t.Error("Submit: " + err.Error())
+				}
+			}
+			p.Close()
+		}()
+
+		seen := make(map[int]bool)
+		for r := range p.Results() {
+			if ordered && r.Seq != len(seen) {
+				t.Fatalf("wanted result %d, got %d", len(seen), r.Seq)
+			}
+			seen[r.Seq] = true
+
+			got := matchesString(r.Matches)
+			if r.Err != nil {
+				got = "error"
+			}
+			if got != wanted[r.Seq] || string(r.Event) != string(events[r.Seq]) {
+				t.Errorf("event %d: wanted %s got %s", r.Seq, wanted[r.Seq], got)
+			}
+		}
+		if len(seen) != len(events) {
+			t.Errorf("ordered %v: wanted %d results, got %d", ordered, len(events), len(seen))
+		}
+
+		if err := p.Submit(events[0]); err != ErrPipelineClosed {
+			t.Errorf("wanted ErrPipelineClosed after Close, got %v", err)
+		}
+	}
+}
+
+func Test_Pipeline_Backpressure(t *testing.T) {
+	q := newPipelineMatcher(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := NewPipeline(ctx, q, 2, true)
+
+	// Nobody reads the results, so Submit blocks once the window is full.
+	submitted := make(chan int)
+	go func() {
+		count := 0
+		for _, event := range pipelineEvents(100) {
+			if err := p.Submit(event); err != nil {
+				break
+			}
+			count++
+		}
+		submitted <- count
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case count := <-submitted:
+		// The window of 2 workers is 8 events.
+		if count == 0 || count > 8 {
+			t.Errorf("wanted Submit to block within 8 events, submitted %d", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Submit didn't return after cancelling")
+	}
+
+	// Cancelling closes the results.
+	for range p.Results() {
+	}
+}
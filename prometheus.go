@@ -0,0 +1,142 @@
+package flattener
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the event latency histogram.
+var defaultLatencyBuckets = []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 5e-2, 0.1}
+
+// PrometheusMetrics is a Metrics collecting counters and a latency histogram, exposed in
+// the Prometheus text format (it's an http.Handler for /metrics).
+type PrometheusMetrics struct {
+	// The counters are updated atomically, they come first so they're 64-bit aligned
+	// on 32-bit platforms too.
+	events       uint64
+	bytes        uint64
+	skippedBytes uint64
+	fields       uint64
+	earlyExits   uint64
+	latencySum   uint64 // nanoseconds
+
+	namespace string
+
+	mu     sync.Mutex
+	errors map[string]uint64
+
+	buckets     []float64
+	bucketCount []uint64
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics, the metric names are prefixed by
+// namespace.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:   namespace,
+		errors:      make(map[string]uint64),
+		buckets:     defaultLatencyBuckets,
+		bucketCount: make([]uint64, len(defaultLatencyBuckets)),
+	}
+}
+
+func (p *PrometheusMetrics) ObserveEvent(e EventMetrics) {
+	atomic.AddUint64(&p.events, 1)
+	atomic.AddUint64(&p.bytes, uint64(e.Bytes))
+	atomic.AddUint64(&p.skippedBytes, uint64(e.SkippedBytes))
+	atomic.AddUint64(&p.fields, uint64(e.Fields))
+	if e.EarlyExit {
+		atomic.AddUint64(&p.earlyExits, 1)
+	}
+
+	if e.ErrorKind != "" {
+		p.mu.Lock()
+		p.errors[e.ErrorKind]++
+		p.mu.Unlock()
+	}
+
+	// Buckets aren't cumulative here, they are summed up when written.
+	seconds := e.Duration.Seconds()
+	for i, le := range p.buckets {
+		if seconds <= le {
+			atomic.AddUint64(&p.bucketCount[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&p.latencySum, uint64(e.Duration.Nanoseconds()))
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	for _, c := range []struct {
+		name, help string
+		value      *uint64
+	}{
+		{"events_total", "Events flattened.", &p.events},
+		{"event_bytes_total", "Bytes of the flattened events.", &p.bytes},
+		{"skipped_bytes_total", "Bytes of values skipped without being parsed.", &p.skippedBytes},
+		{"fields_total", "Fields emitted.", &p.fields},
+		{"early_exits_total", "Events whose parsing stopped once all the paths were found.", &p.earlyExits},
+	} {
+		name := p.namespace + "_" + c.name
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, c.help, name, name, atomic.LoadUint64(c.value))
+	}
+
+	p.mu.Lock()
+	kinds := make([]string, 0, len(p.errors))
+	for kind := range p.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	name := p.namespace + "_errors_total"
+	fmt.Fprintf(cw, "# HELP %s Events which failed, by kind of error.\n# TYPE %s counter\n", name, name)
+	for _, kind := range kinds {
+		fmt.Fprintf(cw, "%s{kind=%q} %d\n", name, kind, p.errors[kind])
+	}
+	p.mu.Unlock()
+
+	name = p.namespace + "_event_duration_seconds"
+	fmt.Fprintf(cw, "# HELP %s Time spent flattening an event.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, le := range p.buckets {
+		cumulative += atomic.LoadUint64(&p.bucketCount[i])
+		fmt.Fprintf(cw, "%s_bucket{le=\"%g\"} %d\n", name, le, cumulative)
+	}
+	// Events slower than the last bucket are only in +Inf.
+	fmt.Fprintf(cw, "%s_bucket{le=\"+Inf\"} %d\n", name, atomic.LoadUint64(&p.events))
+	fmt.Fprintf(cw, "%s_sum %g\n", name, float64(atomic.LoadUint64(&p.latencySum))/1e9)
+	fmt.Fprintf(cw, "%s_count %d\n", name, atomic.LoadUint64(&p.events))
+
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = p.WriteTo(w)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package flattener
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_PrometheusMetrics_Exposition(t *testing.T) {
+	p := NewPrometheusMetrics("flattener")
+	p.ObserveEvent(EventMetrics{Bytes: 100, SkippedBytes: 40, Fields: 3, EarlyExit: true, Duration: 3 * time.Microsecond})
+	p.ObserveEvent(EventMetrics{Bytes: 10, ErrorKind: ErrorKindSyntax, Duration: 2 * time.Millisecond})
+	p.ObserveEvent(EventMetrics{Bytes: 5, ErrorKind: ErrorKindSyntax, Duration: time.Second})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE flattener_events_total counter",
+		"flattener_events_total 3",
+		"flattener_event_bytes_total 115",
+		"flattener_skipped_bytes_total 40",
+		"flattener_fields_total 3",
+		"flattener_early_exits_total 1",
+		`flattener_errors_total{kind="syntax"} 2`,
+		"# TYPE flattener_event_duration_seconds histogram",
+		`flattener_event_duration_seconds_bucket{le="1e-06"} 0`,
+		`flattener_event_duration_seconds_bucket{le="5e-06"} 1`,
+		`flattener_event_duration_seconds_bucket{le="0.005"} 2`,
+		`flattener_event_duration_seconds_bucket{le="0.1"} 2`,
+		`flattener_event_duration_seconds_bucket{le="+Inf"} 3`,
+		"flattener_event_duration_seconds_sum 1.002003",
+		"flattener_event_duration_seconds_count 3",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+func Test_PrometheusMetrics_Flattener(t *testing.T) {
+	p := NewPrometheusMetrics("flattener")
+	m, err := NewMatcher(WithMetrics(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddPattern("a", `{"a": [1]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies of the Matcher report to the same metrics.
+	for _, c := range []*Matcher{m, m.Copy()} {
+		if _, err := c.MatchesForEvent([]byte(`{"a": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	if _, err := p.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "flattener_events_total 2\n") {
+		t.Errorf("wanted 2 events, got:\n%s", out.String())
+	}
+}
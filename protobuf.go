@@ -0,0 +1,526 @@
+package flattener
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timbray/quamina"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// ProtoFlattener flattens protobuf messages by walking the wire format directly.
+//
+//	Fields are named and rendered the way protojson renders them, so patterns written
+//	against the JSON form of a message match the binary form. This includes the
+//	well-known types Timestamp, Duration and the wrappers (Int64Value, ...), while
+//	Struct, Value, ListValue, Any and FieldMask are walked as plain messages, so
+//	patterns on their JSON form don't match them.
+type ProtoFlattener struct {
+	paths PathIndex
+	desc  protoreflect.MessageDescriptor
+
+	// useProtoNames makes the flattener use the field names from the .proto file
+	// instead of the lowerCamelCase JSON names, see WithProtoNames.
+	useProtoNames bool
+
+	fields     []quamina.Field
+	arrayCount int32
+	arrayTrail []quamina.ArrayPos
+}
+
+// ProtoOption configures a ProtoFlattener.
+type ProtoOption func(fp *ProtoFlattener)
+
+// WithProtoNames names fields by their names in the .proto file (order_id) instead of
+// their lowerCamelCase JSON names (orderId), like protojson's UseProtoNames.
+func WithProtoNames() ProtoOption {
+	return func(fp *ProtoFlattener) {
+		fp.useProtoNames = true
+	}
+}
+
+// NewProtoFlattener creates a flattener for protobuf messages of desc, emitting the fields
+// in paths.
+func NewProtoFlattener(paths PathIndex, desc protoreflect.MessageDescriptor, opts ...ProtoOption) *ProtoFlattener {
+	fp := &ProtoFlattener{
+		paths:      paths,
+		desc:       desc,
+		fields:     make([]quamina.Field, 0),
+		arrayTrail: make([]quamina.ArrayPos, 0),
+		arrayCount: 0,
+	}
+	for _, opt := range opts {
+		opt(fp)
+	}
+
+	return fp
+}
+
+// NewProtoFlattenerFromDescriptorSet loads a serialized FileDescriptorSet (as produced by
+// `protoc --descriptor_set_out --include_imports`) and flattens messages of the given full name.
+func NewProtoFlattenerFromDescriptorSet(paths PathIndex, file string, messageName string, opts ...ProtoOption) (*ProtoFlattener, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading descriptor set: %s", err)
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, set); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set: %s", err)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("building descriptors: %s", err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("finding message %s: %s", messageName, err)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", messageName)
+	}
+
+	return NewProtoFlattener(paths, md, opts...), nil
+}
+
+func (fp *ProtoFlattener) Copy() quamina.Flattener {
+	return &ProtoFlattener{
+		paths:         fp.paths,
+		desc:          fp.desc,
+		useProtoNames: fp.useProtoNames,
+		fields:        make([]quamina.Field, 0),
+		arrayTrail:    make([]quamina.ArrayPos, 0),
+		arrayCount:    0,
+	}
+}
+
+func (fp *ProtoFlattener) reset() {
+	fp.arrayCount = 0
+	fp.fields = fp.fields[:0]
+	fp.arrayTrail = fp.arrayTrail[:0]
+}
+
+func (fp *ProtoFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	fp.reset()
+
+	if err := fp.traverseMessage(event, fp.desc, fp.paths); err != nil {
+		return fp.fields, err
+	}
+
+	return fp.fields, nil
+}
+
+// protoArray tracks the array a repeated field is flattened into, within a single message.
+//
+//	Elements of a non-packed repeated field don't have to be contiguous on the wire,
+//	so the position has to be remembered per field number.
+type protoArray struct {
+	num protowire.Number
+	pos quamina.ArrayPos
+}
+
+// Traverse a message - the equivalent of JxFlattener.traverseNode.
+//
+//	Every tag which is not a field or node in the index is skipped by its wire type.
+func (fp *ProtoFlattener) traverseMessage(b []byte, md protoreflect.MessageDescriptor, n Node) error {
+	nodeFields := n.getFields()
+	var arrays []protoArray
+
+	for len(b) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return fmt.Errorf("failed reading tag: %s", protowire.ParseError(tagLen))
+		}
+
+		valLen := protowire.ConsumeFieldValue(num, typ, b[tagLen:])
+		if valLen < 0 {
+			return fmt.Errorf("failed reading field %d: %s", num, protowire.ParseError(valLen))
+		}
+
+		val := b[tagLen : tagLen+valLen]
+		b = b[tagLen+valLen:]
+
+		fd := md.Fields().ByNumber(num)
+		if fd == nil {
+			continue
+		}
+
+		name := fd.JSONName()
+		if fp.useProtoNames {
+			name = string(fd.Name())
+		}
+
+		path, isField := nodeFields[name]
+		node, isNode := n.get(name)
+		if !isField && !isNode {
+			continue
+		}
+
+		repeated := fd.Cardinality() == protoreflect.Repeated && !fd.IsMap()
+		arrayIdx := 0
+		if repeated {
+			arrays, arrayIdx = fp.enterRepeated(arrays, num)
+		}
+
+		var err error
+		switch {
+		case fd.IsMap():
+			if isNode {
+				err = fp.traverseMapEntry(val, fd, node)
+			}
+		case fd.Kind() == protoreflect.MessageKind && isProtoWellKnownScalar(fd.Message()):
+			if isField {
+				err = fp.parseWellKnown(path, fd.Message(), skipLengthPrefix(val))
+			}
+		case fd.Kind() == protoreflect.MessageKind:
+			if isNode {
+				err = fp.traverseMessage(skipLengthPrefix(val), fd.Message(), node)
+			}
+		case fd.Kind() == protoreflect.GroupKind:
+			// Groups are deprecated and don't have a JSON form worth matching on.
+		case isField:
+			err = fp.parseScalar(path, fd, typ, val)
+		}
+
+		if repeated {
+			// Packed records advance the position by more than one element.
+			arrays[arrayIdx].pos = fp.arrayTrail[len(fp.arrayTrail)-1]
+			fp.leaveRepeated()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enterRepeated pushes the array position for the next element of a repeated field.
+func (fp *ProtoFlattener) enterRepeated(arrays []protoArray, num protowire.Number) ([]protoArray, int) {
+	for i := range arrays {
+		if arrays[i].num == num {
+			arrays[i].pos.Pos++
+			fp.arrayTrail = append(fp.arrayTrail, arrays[i].pos)
+			return arrays, i
+		}
+	}
+
+	fp.arrayCount++
+	pos := quamina.ArrayPos{Array: fp.arrayCount, Pos: 1}
+	fp.arrayTrail = append(fp.arrayTrail, pos)
+	return append(arrays, protoArray{num: num, pos: pos}), len(arrays)
+}
+
+func (fp *ProtoFlattener) leaveRepeated() {
+	fp.arrayTrail = fp.arrayTrail[:len(fp.arrayTrail)-1]
+}
+
+// traverseMapEntry handles one entry of a map field, in JSON a map is an object keyed
+// by the string form of the map key.
+func (fp *ProtoFlattener) traverseMapEntry(val []byte, fd protoreflect.FieldDescriptor, n Node) error {
+	entry := skipLengthPrefix(val)
+
+	var key []byte
+	var valTyp protowire.Type
+	var value []byte
+	hasValue := false
+
+	for len(entry) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(entry)
+		if tagLen < 0 {
+			return fmt.Errorf("failed reading map entry: %s", protowire.ParseError(tagLen))
+		}
+		valLen := protowire.ConsumeFieldValue(num, typ, entry[tagLen:])
+		if valLen < 0 {
+			return fmt.Errorf("failed reading map entry: %s", protowire.ParseError(valLen))
+		}
+
+		switch num {
+		case 1:
+			if fd.MapKey().Kind() == protoreflect.StringKind {
+				key = skipLengthPrefix(entry[tagLen : tagLen+valLen])
+			} else {
+				key = formatProtoScalar(nil, fd.MapKey(), entry[tagLen:tagLen+valLen])
+			}
+		case 2:
+			valTyp, value, hasValue = typ, entry[tagLen:tagLen+valLen], true
+		}
+		entry = entry[tagLen+valLen:]
+	}
+
+	if fd.MapKey().Kind() != protoreflect.StringKind {
+		if key == nil {
+			key = formatProtoScalar(nil, fd.MapKey(), nil)
+		}
+
+		// JSON object keys are always strings, remove the quotes 64 bit keys were rendered with.
+		if key[0] == '"' {
+			key = key[1 : len(key)-1]
+		}
+	}
+
+	valueFd := fd.MapValue()
+	if valueFd.Kind() == protoreflect.MessageKind && !isProtoWellKnownScalar(valueFd.Message()) {
+		node, ok := n.get(BinaryString(key))
+		if !ok || !hasValue {
+			return nil
+		}
+		return fp.traverseMessage(skipLengthPrefix(value), valueFd.Message(), node)
+	}
+
+	path, ok := n.getFields()[BinaryString(key)]
+	if !ok {
+		return nil
+	}
+	if valueFd.Kind() == protoreflect.MessageKind {
+		return fp.parseWellKnown(path, valueFd.Message(), skipLengthPrefix(value))
+	}
+	if !hasValue {
+		valTyp, value = protowire.VarintType, []byte{0}
+		if valueFd.Kind() == protoreflect.StringKind || valueFd.Kind() == protoreflect.BytesKind {
+			valTyp = protowire.BytesType
+		}
+	}
+
+	return fp.parseScalar(path, valueFd, valTyp, value)
+}
+
+// parseScalar emits a scalar field, packed repeated fields carry several values in a single
+// length-delimited record.
+func (fp *ProtoFlattener) parseScalar(path []byte, fd protoreflect.FieldDescriptor, typ protowire.Type, val []byte) error {
+	if typ != protowire.BytesType || fd.Kind() == protoreflect.StringKind || fd.Kind() == protoreflect.BytesKind {
+		fp.storeField(path, formatProtoScalar(nil, fd, val))
+		return nil
+	}
+
+	packed := skipLengthPrefix(val)
+
+	// The trail already points at the element of this record, elements after the
+	// first one continue from there.
+	first := true
+	for len(packed) > 0 {
+		n := consumePackedValue(fd.Kind(), packed)
+		if n < 0 {
+			return fmt.Errorf("failed reading packed field %s: %s", fd.Name(), protowire.ParseError(n))
+		}
+
+		if !first {
+			fp.arrayTrail[len(fp.arrayTrail)-1].Pos++
+		}
+		first = false
+
+		fp.storeField(path, formatProtoScalar(nil, fd, packed[:n]))
+		packed = packed[n:]
+	}
+
+	return nil
+}
+
+// parseWellKnown emits a well-known type protojson renders as a single value, b is the
+// message without its length prefix.
+func (fp *ProtoFlattener) parseWellKnown(path []byte, md protoreflect.MessageDescriptor, b []byte) error {
+	val, err := formatProtoWellKnown(md, b)
+	if err != nil {
+		return fmt.Errorf("failed reading %s: %s", md.FullName(), err)
+	}
+
+	fp.storeField(path, val)
+	return nil
+}
+
+func (fp *ProtoFlattener) storeField(path []byte, val []byte) {
+	f := quamina.Field{Path: path, Val: val}
+	if len(fp.arrayTrail) > 0 {
+		f.ArrayTrail = make([]quamina.ArrayPos, len(fp.arrayTrail))
+		copy(f.ArrayTrail, fp.arrayTrail)
+	}
+	fp.fields = append(fp.fields, f)
+}
+
+func skipLengthPrefix(val []byte) []byte {
+	v, n := protowire.ConsumeBytes(val)
+	if n < 0 {
+		return nil
+	}
+	return v
+}
+
+func consumePackedValue(kind protoreflect.Kind, b []byte) int {
+	switch kind {
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.FloatKind:
+		_, n := protowire.ConsumeFixed32(b)
+		return n
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.DoubleKind:
+		_, n := protowire.ConsumeFixed64(b)
+		return n
+	default:
+		_, n := protowire.ConsumeVarint(b)
+		return n
+	}
+}
+
+// formatProtoScalar renders a single wire value the way protojson would.
+//
+//	A nil val renders the default value of the field.
+func formatProtoScalar(dst []byte, fd protoreflect.FieldDescriptor, val []byte) []byte {
+	var v uint64
+	switch fd.Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind:
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.FloatKind:
+		x, _ := protowire.ConsumeFixed32(val)
+		v = uint64(x)
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.DoubleKind:
+		v, _ = protowire.ConsumeFixed64(val)
+	default:
+		v, _ = protowire.ConsumeVarint(val)
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return strconv.AppendBool(dst, v != 0)
+	case protoreflect.Int32Kind:
+		return strconv.AppendInt(dst, int64(int32(v)), 10)
+	case protoreflect.Sint32Kind:
+		return strconv.AppendInt(dst, int64(int32(protowire.DecodeZigZag(v&math.MaxUint32))), 10)
+	case protoreflect.Sfixed32Kind:
+		return strconv.AppendInt(dst, int64(int32(v)), 10)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return strconv.AppendUint(dst, uint64(uint32(v)), 10)
+
+	// 64 bit integers are rendered as strings in JSON, since they don't fit into a double.
+	case protoreflect.Int64Kind, protoreflect.Sfixed64Kind:
+		return append(strconv.AppendInt(append(dst, '"'), int64(v), 10), '"')
+	case protoreflect.Sint64Kind:
+		return append(strconv.AppendInt(append(dst, '"'), protowire.DecodeZigZag(v), 10), '"')
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return append(strconv.AppendUint(append(dst, '"'), v, 10), '"')
+
+	case protoreflect.FloatKind:
+		return appendJSONFloat(dst, float64(math.Float32frombits(uint32(v))), 32)
+	case protoreflect.DoubleKind:
+		return appendJSONFloat(dst, math.Float64frombits(v), 64)
+
+	case protoreflect.EnumKind:
+		ev := fd.Enum().Values().ByNumber(protoreflect.EnumNumber(int32(v)))
+		if ev == nil {
+			return strconv.AppendInt(dst, int64(int32(v)), 10)
+		}
+		return appendJSONString(dst, string(ev.Name()), false)
+
+	case protoreflect.StringKind:
+		return appendJSONString(dst, BinaryString(skipLengthPrefix(val)), false)
+	case protoreflect.BytesKind:
+		b := skipLengthPrefix(val)
+		dst = append(dst, '"')
+		n := len(dst)
+		dst = append(dst, make([]byte, base64.StdEncoding.EncodedLen(len(b)))...)
+		base64.StdEncoding.Encode(dst[n:], b)
+		return append(dst, '"')
+	}
+
+	return dst
+}
+
+// isProtoWellKnownScalar reports whether md is a well-known type protojson renders as a
+// single JSON value instead of an object.
+func isProtoWellKnownScalar(md protoreflect.MessageDescriptor) bool {
+	switch md.FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration",
+		"google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		return true
+	}
+	return false
+}
+
+// formatProtoWellKnown renders a message for which isProtoWellKnownScalar is true the way
+// protojson would: timestamps as RFC 3339 strings, durations as "1.5s" and wrappers as
+// the value they wrap.
+func formatProtoWellKnown(md protoreflect.MessageDescriptor, b []byte) ([]byte, error) {
+	// All of them have at most 2 fields, a field which is repeated on the wire is
+	// overridden by its last occurrence.
+	var vals [3][]byte
+	for len(b) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return nil, protowire.ParseError(tagLen)
+		}
+		valLen := protowire.ConsumeFieldValue(num, typ, b[tagLen:])
+		if valLen < 0 {
+			return nil, protowire.ParseError(valLen)
+		}
+
+		if num == 1 || num == 2 {
+			vals[num] = b[tagLen : tagLen+valLen]
+		}
+		b = b[tagLen+valLen:]
+	}
+
+	secs, _ := protowire.ConsumeVarint(vals[1])
+	nanos, _ := protowire.ConsumeVarint(vals[2])
+
+	switch md.FullName() {
+	case "google.protobuf.Timestamp":
+		return appendProtoTimestamp(nil, int64(secs), int32(nanos))
+	case "google.protobuf.Duration":
+		return appendProtoDuration(nil, int64(secs), int32(nanos))
+	}
+
+	return formatProtoScalar(nil, md.Fields().ByNumber(1), vals[1]), nil
+}
+
+const (
+	// minProtoTimestamp and maxProtoTimestamp are 0001-01-01T00:00:00Z and
+	// 9999-12-31T23:59:59Z, the range protojson accepts.
+	minProtoTimestamp = -62135596800
+	maxProtoTimestamp = 253402300799
+
+	// maxProtoDuration is 10000 years in seconds.
+	maxProtoDuration = 315576000000
+)
+
+func appendProtoTimestamp(dst []byte, secs int64, nanos int32) ([]byte, error) {
+	if secs < minProtoTimestamp || secs > maxProtoTimestamp || nanos < 0 || nanos >= 1e9 {
+		return nil, fmt.Errorf("timestamp out of range: %d.%09d", secs, nanos)
+	}
+
+	x := time.Unix(secs, int64(nanos)).UTC().Format("2006-01-02T15:04:05.000000000")
+	return appendJSONString(dst, trimProtoNanos(x)+"Z", false), nil
+}
+
+func appendProtoDuration(dst []byte, secs int64, nanos int32) ([]byte, error) {
+	if secs < -maxProtoDuration || secs > maxProtoDuration || nanos <= -1e9 || nanos >= 1e9 ||
+		secs > 0 && nanos < 0 || secs < 0 && nanos > 0 {
+		return nil, fmt.Errorf("duration out of range: %d.%09d", secs, nanos)
+	}
+
+	sign := ""
+	if secs < 0 || nanos < 0 {
+		sign, secs, nanos = "-", -secs, -nanos
+	}
+	x := fmt.Sprintf("%s%d.%09d", sign, secs, nanos)
+	return appendJSONString(dst, trimProtoNanos(x)+"s", false), nil
+}
+
+// trimProtoNanos keeps 0, 3, 6 or 9 fractional digits, as few as needed.
+func trimProtoNanos(x string) string {
+	x = strings.TrimSuffix(x, "000")
+	x = strings.TrimSuffix(x, "000")
+	return strings.TrimSuffix(x, ".000")
+}
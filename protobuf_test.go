@@ -0,0 +1,439 @@
+package flattener
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timbray/quamina"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// orderDescriptor builds the descriptor of:
+//
+//	message Address { string city = 1; }
+//	message Order {
+//	  enum Status { UNKNOWN = 0; SHIPPED = 1; }
+//	  string order_id = 1;
+//	  int64 total = 2;
+//	  Status status = 3;
+//	  Address address = 4;
+//	  repeated int32 quantities = 5;
+//	  map<string, string> labels = 6;
+//	  double weight = 7;
+//	  repeated Address stops = 8;
+//	}
+func orderDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(protoJSONName(name)),
+			Number:   proto.Int32(num),
+			Type:     typ.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("order.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Address"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("city", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("Order"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("order_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("total", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+					field("status", 3, descriptorpb.FieldDescriptorProto_TYPE_ENUM, optional, ".test.Order.Status"),
+					field("address", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".test.Address"),
+					field("quantities", 5, descriptorpb.FieldDescriptorProto_TYPE_INT32, repeated, ""),
+					field("labels", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".test.Order.LabelsEntry"),
+					field("weight", 7, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional, ""),
+					field("stops", 8, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, ".test.Address"),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("LabelsEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+							field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+				EnumType: []*descriptorpb.EnumDescriptorProto{
+					{
+						Name: proto.String("Status"),
+						Value: []*descriptorpb.EnumValueDescriptorProto{
+							{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+							{Name: proto.String("SHIPPED"), Number: proto.Int32(1)},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatal("descriptor: " + err.Error())
+	}
+	return fd.Messages().ByName("Order")
+}
+
+func protoJSONName(name string) string {
+	out := make([]byte, 0, len(name))
+	upper := false
+	for i := 0; i < len(name); i++ {
+		if name[i] == '_' {
+			upper = true
+			continue
+		}
+		c := name[i]
+		if upper && c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+func newOrder(t *testing.T, md protoreflect.MessageDescriptor) *dynamicpb.Message {
+	order := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+
+	order.Set(fields.ByName("order_id"), protoreflect.ValueOfString(`A-"17"`))
+	order.Set(fields.ByName("total"), protoreflect.ValueOfInt64(1234))
+	order.Set(fields.ByName("status"), protoreflect.ValueOfEnum(1))
+	order.Set(fields.ByName("weight"), protoreflect.ValueOfFloat64(2.5))
+
+	address := order.Mutable(fields.ByName("address")).Message()
+	address.Set(address.Descriptor().Fields().ByName("city"), protoreflect.ValueOfString("Tel Aviv"))
+
+	quantities := order.Mutable(fields.ByName("quantities")).List()
+	quantities.Append(protoreflect.ValueOfInt32(3))
+	quantities.Append(protoreflect.ValueOfInt32(-7))
+
+	labels := order.Mutable(fields.ByName("labels")).Map()
+	labels.Set(protoreflect.ValueOfString("team").MapKey(), protoreflect.ValueOfString("payments"))
+
+	return order
+}
+
+func Test_Proto_MatchesJSONForm(t *testing.T) {
+	md := orderDescriptor(t)
+	order := newOrder(t, md)
+
+	wire, err := proto.Marshal(order)
+	if err != nil {
+		t.Fatal("marshal: " + err.Error())
+	}
+	asJSON, err := protojson.Marshal(order)
+	if err != nil {
+		t.Fatal("marshal json: " + err.Error())
+	}
+
+	paths := NewPaths()
+	for _, path := range []string{"orderId", "total", "status", "address\ncity", "quantities", "labels\nteam", "weight"} {
+		paths.Add(path)
+	}
+
+	protoFields, err := NewProtoFlattener(paths, md).Flatten(wire, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	jxFields, err := NewJxFlattener(paths).Flatten(asJSON, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	if got, wanted := fieldsSet(protoFields), fieldsSet(jxFields); got != wanted {
+		t.Errorf("proto fields differ from JSON form\ngot:    %s\nwanted: %s", got, wanted)
+	}
+}
+
+func Test_Proto_RepeatedMessages(t *testing.T) {
+	md := orderDescriptor(t)
+	order := newOrder(t, md)
+
+	stops := order.Mutable(md.Fields().ByName("stops")).List()
+	for _, city := range []string{"Haifa", "Eilat"} {
+		stop := stops.NewElement()
+		stop.Message().Set(stop.Message().Descriptor().Fields().ByName("city"), protoreflect.ValueOfString(city))
+		stops.Append(stop)
+	}
+
+	wire, err := proto.Marshal(order)
+	if err != nil {
+		t.Fatal("marshal: " + err.Error())
+	}
+
+	paths := NewPaths()
+	paths.Add("stops\ncity")
+	paths.Add("quantities")
+
+	fields, err := NewProtoFlattener(paths, md).Flatten(wire, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	// Every stop is an element of the same array, apart from the quantities one. The
+	// wire order of dynamic messages isn't stable, so neither are the array numbers.
+	got := make(map[string]quamina.ArrayPos)
+	for _, f := range fields {
+		if len(f.ArrayTrail) != 1 {
+			t.Fatalf("%s: wanted a single array, got %v", f.Path, f.ArrayTrail)
+		}
+		got[string(f.Path)+"="+string(f.Val)] = f.ArrayTrail[0]
+	}
+	stopsArray, quantitiesArray := got["stops\ncity=\"Haifa\""].Array, got["quantities=3"].Array
+	wanted := map[string]quamina.ArrayPos{
+		"stops\ncity=\"Haifa\"": {Array: stopsArray, Pos: 1},
+		"stops\ncity=\"Eilat\"": {Array: stopsArray, Pos: 2},
+		"quantities=3":          {Array: quantitiesArray, Pos: 1},
+		"quantities=-7":         {Array: quantitiesArray, Pos: 2},
+	}
+	if stopsArray == quantitiesArray || !reflect.DeepEqual(got, wanted) {
+		t.Errorf("wanted %v got %v", wanted, got)
+	}
+}
+
+func Test_Proto_ProtoNames(t *testing.T) {
+	md := orderDescriptor(t)
+	wire, err := proto.Marshal(newOrder(t, md))
+	if err != nil {
+		t.Fatal("marshal: " + err.Error())
+	}
+
+	paths := NewPaths()
+	paths.Add("order_id")
+	paths.Add("orderId")
+
+	fields, err := NewProtoFlattener(paths, md).Flatten(wire, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	if got, wanted := fieldsSet(fields), `["orderId"="A-\"17\"" []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	fp := NewProtoFlattener(paths, md, WithProtoNames())
+	for _, f := range []quamina.Flattener{fp, fp.Copy()} {
+		fields, err := f.Flatten(wire, nil)
+		if err != nil {
+			t.Fatal("Flatten: " + err.Error())
+		}
+		if got, wanted := fieldsSet(fields), `["order_id"="A-\"17\"" []]`; got != wanted {
+			t.Errorf("wanted %s got %s", wanted, got)
+		}
+	}
+}
+
+// eventDescriptor builds the descriptor of:
+//
+//	message Event {
+//	  google.protobuf.Timestamp ts = 1;
+//	  google.protobuf.Duration took = 2;
+//	  google.protobuf.Int64Value count = 3;
+//	  google.protobuf.StringValue note = 4;
+//	  repeated google.protobuf.Timestamp seen = 5;
+//	  map<string, google.protobuf.Duration> delays = 6;
+//	  google.protobuf.Struct attrs = 7;
+//	  google.protobuf.BoolValue flag = 8;
+//	}
+func eventDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	field := func(name string, num int32, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+			Label:    label.Enum(),
+			TypeName: proto.String(typeName),
+		}
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("event.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			"google/protobuf/timestamp.proto", "google/protobuf/duration.proto",
+			"google/protobuf/wrappers.proto", "google/protobuf/struct.proto",
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("ts", 1, optional, ".google.protobuf.Timestamp"),
+					field("took", 2, optional, ".google.protobuf.Duration"),
+					field("count", 3, optional, ".google.protobuf.Int64Value"),
+					field("note", 4, optional, ".google.protobuf.StringValue"),
+					field("seen", 5, repeated, ".google.protobuf.Timestamp"),
+					field("delays", 6, repeated, ".test.Event.DelaysEntry"),
+					field("attrs", 7, optional, ".google.protobuf.Struct"),
+					field("flag", 8, optional, ".google.protobuf.BoolValue"),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("DelaysEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							{
+								Name:     proto.String("key"),
+								JsonName: proto.String("key"),
+								Number:   proto.Int32(1),
+								Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+								Label:    optional.Enum(),
+							},
+							field("value", 2, optional, ".google.protobuf.Duration"),
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}
+
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal("descriptor: " + err.Error())
+	}
+	return fd.Messages().ByName("Event")
+}
+
+func Test_Proto_WellKnownTypes(t *testing.T) {
+	md := eventDescriptor(t)
+	event := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+
+	set := func(name string, m proto.Message) {
+		event.Set(fields.ByName(protoreflect.Name(name)), protoreflect.ValueOfMessage(m.ProtoReflect()))
+	}
+	set("ts", timestamppb.New(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+	set("took", durationpb.New(-1500*time.Millisecond))
+	set("count", wrapperspb.Int64(42))
+	set("note", wrapperspb.String(""))
+	set("flag", wrapperspb.Bool(false))
+
+	attrs, err := structpb.NewStruct(map[string]interface{}{"k": "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set("attrs", attrs)
+
+	seen := event.Mutable(fields.ByName("seen")).List()
+	for _, nanos := range []int{0, 500000000, 123456789} {
+		seen.Append(protoreflect.ValueOfMessage(timestamppb.New(time.Unix(1700000000, int64(nanos))).ProtoReflect()))
+	}
+
+	delays := event.Mutable(fields.ByName("delays")).Map()
+	delays.Set(protoreflect.ValueOfString("fast").MapKey(), protoreflect.ValueOfMessage(durationpb.New(3*time.Millisecond).ProtoReflect()))
+
+	wire, err := proto.Marshal(event)
+	if err != nil {
+		t.Fatal("marshal: " + err.Error())
+	}
+	asJSON, err := protojson.Marshal(event)
+	if err != nil {
+		t.Fatal("marshal json: " + err.Error())
+	}
+
+	paths := NewPaths()
+	for _, path := range []string{"ts", "took", "count", "note", "seen", "delays\nfast", "flag"} {
+		paths.Add(path)
+	}
+
+	protoFields, err := NewProtoFlattener(paths, md).Flatten(wire, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	jxFields, err := NewJxFlattener(paths).Flatten(asJSON, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+	if got, wanted := fieldsSet(protoFields), fieldsSet(jxFields); got != wanted {
+		t.Errorf("proto fields differ from JSON form\ngot:    %s\nwanted: %s", got, wanted)
+	}
+
+	// Struct is walked as a plain message, so its JSON form isn't matched.
+	paths = NewPaths()
+	paths.Add("attrs\nk")
+	if fields, err := NewJxFlattener(paths).Flatten(asJSON, nil); err != nil || len(fields) != 1 {
+		t.Fatalf("wanted attrs.k in the JSON form, got %s (%v)", fieldsSet(fields), err)
+	}
+	if fields, err := NewProtoFlattener(paths, md).Flatten(wire, nil); err != nil || len(fields) != 0 {
+		t.Errorf("wanted no fields for a Struct, got %s (%v)", fieldsSet(fields), err)
+	}
+}
+
+func Test_Proto_SkipsUnindexed(t *testing.T) {
+	md := orderDescriptor(t)
+	wire, err := proto.Marshal(newOrder(t, md))
+	if err != nil {
+		t.Fatal("marshal: " + err.Error())
+	}
+
+	paths := NewPaths()
+	paths.Add("address\ncity")
+
+	fields, err := NewProtoFlattener(paths, md).Flatten(wire, nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	if len(fields) != 1 || string(fields[0].Val) != `"Tel Aviv"` {
+		t.Errorf("wanted only address city, got %s", fieldsSet(fields))
+	}
+}
+
+func Test_Proto_Matching(t *testing.T) {
+	md := orderDescriptor(t)
+	wire, err := proto.Marshal(newOrder(t, md))
+	if err != nil {
+		t.Fatal("marshal: " + err.Error())
+	}
+
+	pattern := `{"status": ["SHIPPED"], "address": {"city": ["Tel Aviv"]}}`
+	paths := NewPaths()
+	if err := paths.AddPattern(pattern); err != nil {
+		t.Fatal("addPattern: " + err.Error())
+	}
+
+	m := newCustomCoreMatcher(NewProtoFlattener(paths, md))
+	if err := m.AddPattern("shipped", pattern); err != nil {
+		t.Fatal("AddPattern: " + err.Error())
+	}
+
+	matches, err := m.MatchesForEvent(wire)
+	if err != nil {
+		t.Fatal("MatchesForEvent: " + err.Error())
+	}
+	if len(matches) != 1 || matches[0] != quamina.X("shipped") {
+		t.Errorf("wanted shipped, got %v", matches)
+	}
+}
@@ -0,0 +1,85 @@
+package flattener
+
+// The shape cache learns the layout of recurring events: for every node it remembers
+// the keys of the object in the order they were seen in the last event, with what the
+// PathIndex holds for them. Producers usually emit the keys in a stable order, so the
+// key at each position is verified against the prediction (a comparison of the key)
+// instead of looked up in the node's maps. A key which doesn't match the prediction is
+// looked up as usual and the shape is learned again from it on.
+//
+//	Every key of the event is still read, so a miss never changes the fields. A node
+//	which gains paths after its shape was learned is learned again.
+
+// WithShapeCache enables the shape cache, ShapeStats shows whether it pays off.
+func WithShapeCache() Option {
+	return func(fj *JxFlattener) {
+		fj.shapes = make(map[*nodeSettings]*nodeShape)
+	}
+}
+
+type nodeShape struct {
+	keys []keyLookup
+
+	// added is the count of names the node had when its keys were learned.
+	added int
+}
+
+// keyLookup is what a node of the PathIndex holds for a key.
+type keyLookup struct {
+	key     string
+	node    Node
+	found   bool
+	path    []byte
+	isField bool
+}
+
+// ShapeStats returns how many keys were predicted by the shape cache and how many were
+// looked up after a wrong prediction.
+func (fj *JxFlattener) ShapeStats() (hits uint64, misses uint64) {
+	return fj.shapeHits, fj.shapeMisses
+}
+
+// shapeOf returns the shape learned for a node, nil when the cache is disabled.
+func (fj *JxFlattener) shapeOf(n Node) *nodeShape {
+	if fj.shapes == nil {
+		return nil
+	}
+
+	settings := n.getSettings()
+	shape, ok := fj.shapes[settings]
+	if !ok {
+		shape = &nodeShape{added: settings.added}
+		fj.shapes[settings] = shape
+	} else if shape.added != settings.added {
+		shape.keys = shape.keys[:0]
+		shape.added = settings.added
+	}
+
+	return shape
+}
+
+// lookupKey returns what the node holds for the key at ordinal position of its object,
+// keys rejected by the node's prefilter aren't looked up.
+func (fj *JxFlattener) lookupKey(n Node, fields map[string][]byte, filter *keyFilter, shape *nodeShape, ordinal int, keyBytes []byte) keyLookup {
+	key := BinaryString(keyBytes)
+	if shape != nil && ordinal < len(shape.keys) && shape.keys[ordinal].key == key {
+		fj.shapeHits++
+		return shape.keys[ordinal]
+	}
+
+	k := keyLookup{key: key}
+	if filter.mayContain(keyBytes) {
+		k.node, k.found = n.get(key)
+		k.path, k.isField = fields[key]
+	}
+
+	if shape != nil {
+		fj.shapeMisses++
+
+		// The key points into the event, the shape keeps a copy of it.
+		k.key = string(keyBytes)
+		shape.keys = append(shape.keys[:ordinal], k)
+	}
+
+	return k
+}
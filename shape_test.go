@@ -0,0 +1,124 @@
+package flattener
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func Test_Shape_Predictions(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("user\nname")
+	paths.Add("extra")
+
+	fj := NewJxFlattener(paths, WithShapeCache())
+	flatten := func(event string) string {
+		fields, err := fj.Flatten([]byte(event), nil)
+		if err != nil {
+			t.Fatal("Flatten: " + err.Error())
+		}
+		return fieldsSet(fields)
+	}
+
+	// The first event teaches the shape, the second one is predicted.
+	flatten(`{"id": 1, "ts": 5, "user": {"name": "a", "age": 3}}`)
+	if hits, misses := fj.ShapeStats(); hits != 0 || misses != 5 {
+		t.Errorf("wanted 0 hits and 5 misses, got %d and %d", hits, misses)
+	}
+
+	got := flatten(`{"id": 2, "ts": 6, "user": {"name": "b", "age": 4}}`)
+	if wanted := `["id"=2 []]["user\nname"="b" []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if hits, misses := fj.ShapeStats(); hits != 5 || misses != 5 {
+		t.Errorf("wanted 5 hits and 5 misses, got %d and %d", hits, misses)
+	}
+
+	// A key which wasn't predicted is still found.
+	got = flatten(`{"id": 3, "extra": true, "ts": 6, "user": {"name": "c", "age": 4}}`)
+	if wanted := `["extra"=true []]["id"=3 []]["user\nname"="c" []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if hits, misses := fj.ShapeStats(); hits != 8 || misses != 8 {
+		t.Errorf("wanted 8 hits and 8 misses, got %d and %d", hits, misses)
+	}
+
+	// A path added after the shape was learned is found, its node is learned again.
+	paths.Add("ts")
+	got = flatten(`{"id": 4, "extra": true, "ts": 7, "user": {"name": "d", "age": 4}}`)
+	if wanted := `["extra"=true []]["id"=4 []]["ts"=7 []]["user\nname"="d" []]`; got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if hits, misses := fj.ShapeStats(); hits != 10 || misses != 12 {
+		t.Errorf("wanted 10 hits and 12 misses, got %d and %d", hits, misses)
+	}
+
+	// Copies learn on their own.
+	if hits, misses := fj.Copy().(*JxFlattener).ShapeStats(); hits != 0 || misses != 0 {
+		t.Errorf("wanted a copy without stats, got %d and %d", hits, misses)
+	}
+}
+
+func Test_Shape_MatchesJX(t *testing.T) {
+	g := &randomJSON{r: rand.New(rand.NewSource(2)), paths: make(map[string]bool)}
+
+	events := make([][]byte, 500)
+	for i := range events {
+		g.b.Reset()
+		g.object("", 0)
+		events[i] = []byte(g.b.String())
+	}
+
+	paths := NewPaths()
+	for path := range g.paths {
+		if g.r.Intn(2) == 0 {
+			paths.Add(path)
+		}
+	}
+
+	fj := NewJxFlattener(paths)
+	shaped := NewJxFlattener(paths, WithShapeCache())
+	for _, event := range events {
+		wanted, wantedErr := fj.Flatten(event, nil)
+		got, err := shaped.Flatten(event, nil)
+		if (err != nil) != (wantedErr != nil) {
+			t.Fatalf("wanted error %v, got %v for %s", wantedErr, err, event)
+		}
+		if fieldsSet(got) != fieldsSet(wanted) {
+			t.Fatalf("fields differ for %s\ngot:    %s\nwanted: %s", event, fieldsSet(got), fieldsSet(wanted))
+		}
+	}
+}
+
+func Benchmark_ShapeCache(b *testing.B) {
+	// A wide event with a stable key order, only a few keys are indexed.
+	var event strings.Builder
+	event.WriteString(`{"id": "e-1"`)
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&event, `, "attribute_%d": %d`, i, i)
+	}
+	event.WriteString(`, "detail": {"state": "running", "code": 7}}`)
+	data := []byte(event.String())
+
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("attribute_17")
+	paths.Add("detail\nstate")
+
+	for name, fj := range map[string]*JxFlattener{
+		"off": NewJxFlattener(paths, WithStructuralIndex()),
+		"on":  NewJxFlattener(paths, WithStructuralIndex(), WithShapeCache()),
+	} {
+		fj := fj
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := fj.Flatten(data, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
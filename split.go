@@ -0,0 +1,262 @@
+package flattener
+
+import (
+	"fmt"
+
+	"github.com/timbray/quamina"
+)
+
+// FlattenedEvent is a single event found by FlattenAll, Start and End are its byte range
+// in the input.
+type FlattenedEvent struct {
+	Start  int
+	End    int
+	Fields []quamina.Field
+}
+
+// FlattenAll splits an input holding several events and flattens each of them on its
+// own, the input is either concatenated objects ({..}{..}, optionally separated by
+// whitespace) or a single top-level array of objects.
+//
+//	The fields of all events share the flattener's buffers, so they are valid until the
+//	next call.
+func (fj *JxFlattener) FlattenAll(input []byte) ([]FlattenedEvent, error) {
+	fj.reset()
+	fj.events = fj.events[:0]
+
+	// Fields are collected for all events before slicing them, since fj.fields might
+	// grow while flattening the next events.
+	offsets := make([]int, 0, 8)
+	err := splitJSONEvents(input, fj.lenient, func(start, end int) error {
+		fj.arrayCount = 0
+		offsets = append(offsets, len(fj.fields))
+
+		if err := fj.flattenEvent(input[start:end]); err != nil {
+			return fmt.Errorf("FlattenAll: event at offset %d: %s", start, err)
+		}
+
+		fj.events = append(fj.events, FlattenedEvent{Start: start, End: end})
+		return nil
+	})
+
+	for i := range fj.events {
+		end := len(fj.fields)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		fj.events[i].Fields = fj.fields[offsets[i]:end:end]
+	}
+
+	return fj.events, err
+}
+
+// flattenEvent flattens a single event, appending to the current fields.
+func (fj *JxFlattener) flattenEvent(event []byte) error {
+	if fj.metrics != nil {
+		return fj.observeEvent(event)
+	}
+	return fj.parseEvent(event)
+}
+
+func (fj *JxFlattener) parseEvent(event []byte) error {
+	if fj.lenient {
+		// The fields point into the normalized event, so it's kept with the other values.
+		start := len(fj.values)
+
+		var err error
+		if fj.values, err = AppendNormalizedJSON(fj.values, event); err != nil {
+			fj.stats.errorKind = ErrorKindLenient
+			return err
+		}
+		event = fj.values[start:len(fj.values):len(fj.values)]
+	}
+
+	fj.tok = fj.getTokenizer(event)
+	defer fj.putTokenizer(fj.tok)
+
+	return fj.traverseNode(fj.paths)
+}
+
+// splitJSONEvents calls fn with the byte range of every event in the input, lenient
+// also skips comments and trailing commas between events.
+func splitJSONEvents(input []byte, lenient bool, fn func(start, end int) error) error {
+	skipSpace := skipJSONSpace
+	if lenient {
+		skipSpace = skipLenientJSONSpace
+	}
+
+	i := skipSpace(input, 0)
+	if i < 0 {
+		return fmt.Errorf("splitJSONEvents: unterminated comment")
+	}
+	if i == len(input) {
+		return nil
+	}
+
+	if input[i] != '[' {
+		for i < len(input) {
+			end, err := jsonValueEnd(input, i, lenient)
+			if err != nil {
+				return err
+			}
+			if err := fn(i, end); err != nil {
+				return err
+			}
+			if i = skipSpace(input, end); i < 0 {
+				return fmt.Errorf("splitJSONEvents: unterminated comment")
+			}
+		}
+		return nil
+	}
+
+	// A top-level array, every element is an event.
+	i = skipSpace(input, i+1)
+	for i >= 0 && i < len(input) && input[i] != ']' {
+		end, err := jsonValueEnd(input, i, lenient)
+		if err != nil {
+			return err
+		}
+		if err := fn(i, end); err != nil {
+			return err
+		}
+
+		if i = skipSpace(input, end); i < 0 || i == len(input) || input[i] == ']' {
+			break
+		}
+		if input[i] != ',' {
+			return fmt.Errorf("splitJSONEvents: unexpected %q at offset %d, wanted ',' or ']'", input[i], i)
+		}
+
+		// Only the lenient mode accepts a trailing comma.
+		if i = skipSpace(input, i+1); !lenient && i < len(input) && input[i] == ']' {
+			return fmt.Errorf("splitJSONEvents: unexpected ']' at offset %d", i)
+		}
+	}
+	if i < 0 || i == len(input) {
+		return fmt.Errorf("splitJSONEvents: unterminated array")
+	}
+
+	if i = skipSpace(input, i+1); i != len(input) {
+		return fmt.Errorf("splitJSONEvents: unexpected data after the array at offset %d", i)
+	}
+	return nil
+}
+
+func skipJSONSpace(input []byte, i int) int {
+	for i < len(input) {
+		switch input[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipLenientJSONSpace skips whitespace and comments, it returns -1 on an unterminated
+// comment.
+func skipLenientJSONSpace(input []byte, i int) int {
+	for {
+		if i = skipJSONSpace(input, i); i == len(input) || input[i] != '/' {
+			return i
+		}
+
+		end, err := jsonCommentEnd(input, i)
+		if err != nil {
+			// Not a comment, leave it for the decoder.
+			if i+1 < len(input) && input[i+1] == '*' {
+				return -1
+			}
+			return i
+		}
+		i = end
+	}
+}
+
+// jsonValueEnd returns the offset after the value starting at input[i]. Values are
+// only scanned for their boundaries (brackets and strings), not validated - that is
+// left to the decoder. lenient also handles single-quoted strings and comments.
+func jsonValueEnd(input []byte, i int, lenient bool) (int, error) {
+	start := i
+	depth := 0
+
+	for i < len(input) {
+		switch input[i] {
+		case '"':
+			end, err := jsonStringEnd(input, i)
+			if err != nil {
+				return 0, fmt.Errorf("splitJSONEvents: %s", err)
+			}
+			i = end
+		case '\'', '/':
+			if !lenient {
+				i++
+				break
+			}
+
+			var end int
+			var err error
+			if input[i] == '/' {
+				end, err = jsonCommentEnd(input, i)
+			} else {
+				end, err = jsonQuotedEnd(input, i, '\'')
+			}
+			if err != nil {
+				return 0, fmt.Errorf("splitJSONEvents: %s", err)
+			}
+			i = end
+		case '{', '[':
+			depth++
+			i++
+		case '}', ']':
+			if depth == 0 {
+				return 0, fmt.Errorf("splitJSONEvents: unexpected %q at offset %d", input[i], i)
+			}
+			depth--
+			i++
+		default:
+			if depth == 0 {
+				// A scalar ends at the next delimiter.
+				for i < len(input) && !isJSONDelimiter(input[i]) {
+					i++
+				}
+				return i, nil
+			}
+			i++
+		}
+
+		if depth == 0 {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("splitJSONEvents: unterminated value at offset %d", start)
+}
+
+// jsonStringEnd returns the offset after the string starting at input[i].
+func jsonStringEnd(input []byte, i int) (int, error) {
+	return jsonQuotedEnd(input, i, '"')
+}
+
+// jsonQuotedEnd returns the offset after the string quoted by quote starting at input[i].
+func jsonQuotedEnd(input []byte, i int, quote byte) (int, error) {
+	for j := i + 1; j < len(input); j++ {
+		switch input[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unterminated string at offset %d", i)
+}
+
+func isJSONDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', ',', ']', '}', '{', '[', '"':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package flattener
+
+import (
+	"testing"
+)
+
+func Test_Split_Inputs(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+	paths.Add("tags")
+
+	first := `{"id":"a","tags":["x"],"skip":"}{"}`
+	second := `{"id":"b\"}","tags":["y","z"]}`
+
+	inputs := map[string]string{
+		"concatenated": first + second,
+		"newlines":     first + "\n\n" + second + "\n",
+		"array":        " [ " + first + " ,\n" + second + " ] ",
+	}
+
+	fj := NewJxFlattener(paths)
+	for name, input := range inputs {
+		events, err := fj.FlattenAll([]byte(input))
+		if err != nil {
+			t.Fatalf("%s: FlattenAll: %s", name, err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("%s: wanted 2 events, got %d", name, len(events))
+		}
+
+		for i, want := range []string{first, second} {
+			event := events[i]
+			if got := input[event.Start:event.End]; got != want {
+				t.Errorf("%s: event %d: wanted range of %s, got %s", name, i, want, got)
+			}
+
+			// Every event is flattened on its own, array numbers restart with it.
+			fields, err := NewJxFlattener(paths).Flatten([]byte(want), nil)
+			if err != nil {
+				t.Fatal("Flatten: " + err.Error())
+			}
+			if got, wanted := fieldsSet(event.Fields), fieldsSet(fields); got != wanted {
+				t.Errorf("%s: event %d\ngot:    %s\nwanted: %s", name, i, got, wanted)
+			}
+		}
+	}
+}
+
+func Test_Split_Empty(t *testing.T) {
+	fj := NewJxFlattener(NewPaths())
+	for _, input := range []string{"", "  \n", "[]", " [ ] "} {
+		events, err := fj.FlattenAll([]byte(input))
+		if err != nil {
+			t.Errorf("%q: FlattenAll: %s", input, err)
+		}
+		if len(events) != 0 {
+			t.Errorf("%q: wanted no events, got %d", input, len(events))
+		}
+	}
+}
+
+func Test_Split_Malformed(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("id")
+
+	fj := NewJxFlattener(paths)
+	for _, input := range []string{
+		`{"id":1}{"id":`,
+		`[{"id":1}`,
+		`[{"id":1} {"id":2}]`,
+		`[{"id":1}] {"id":2}`,
+		`[1, 2]`,
+		`{"id":"unterminated}`,
+		`}`,
+	} {
+		if _, err := fj.FlattenAll([]byte(input)); err == nil {
+			t.Errorf("%s: wanted error", input)
+		}
+	}
+
+	// Events before the malformed one are returned.
+	events, err := fj.FlattenAll([]byte(`{"id":1}{"id":2}{"id"`))
+	if err == nil || len(events) != 2 {
+		t.Errorf("wanted 2 events and an error, got %d and %v", len(events), err)
+	}
+}
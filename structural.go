@@ -0,0 +1,392 @@
+package flattener
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+
+	"github.com/go-faster/jx"
+)
+
+// The structural index is built in the spirit of simdjson's first stage: every 64
+// bytes of the event are classified into bitmasks of backslashes, quotes and operators
+// ({}[]:,) by a SIMD kernel, and the masks are turned into the positions of the
+// structural characters outside of strings (including both quotes of every string).
+// The positions of matching brackets are then linked, so skipping an object or an
+// array is a jump instead of a scan.
+//
+//	Values are checked only as far as the traversal needs them: keys and returned values
+//	are validated, skipped strings, objects and arrays are only delimited. So the fields
+//	are identical to jx's for valid JSON, while invalid JSON inside a skipped value may
+//	be accepted where jx rejects it.
+
+// WithStructuralIndex tokenizes events with a structural index built by SIMD kernels
+// instead of jx, so skipping large values is a jump. The fields
+// are identical.
+func WithStructuralIndex() Option {
+	return WithTokenizer(NewStructuralTokenizer)
+}
+
+// classifyBlocks fills masks with 3 masks (backslashes, quotes, operators) for every
+// 64 bytes block of data, len(data) is a multiple of 64. It's set to a SIMD kernel by
+// the architecture when one is available.
+var classifyBlocks = classifyBlocksGeneric
+
+func classifyBlocksGeneric(data []byte, masks []uint64) {
+	for b := 0; b*64 < len(data); b++ {
+		var backslashes, quotes, operators uint64
+		for i, c := range data[b*64 : b*64+64] {
+			bit := uint64(1) << i
+			switch c {
+			case '\\':
+				backslashes |= bit
+			case '"':
+				quotes |= bit
+			case '{', '}', '[', ']', ':', ',':
+				operators |= bit
+			}
+		}
+
+		masks[b*3], masks[b*3+1], masks[b*3+2] = backslashes, quotes, operators
+	}
+}
+
+// structuralIndexer carries the state of the previous block into the next one.
+type structuralIndexer struct {
+	// escapeNext is 1 when the previous block ended with an escaping backslash.
+	escapeNext uint64
+	// inString is all ones when the previous block ended inside a string.
+	inString uint64
+}
+
+// structurals returns the mask of structural characters of a block.
+func (si *structuralIndexer) structurals(backslashes, quotes, operators uint64) uint64 {
+	escaped := si.escapeNext
+	si.escapeNext = 0
+
+	// A backslash escapes the next character, unless it's escaped itself. Backslashes
+	// are rare, so they are resolved one by one.
+	escapers := backslashes &^ escaped
+	for escapers != 0 {
+		i := bits.TrailingZeros64(escapers)
+		if i == 63 {
+			si.escapeNext = 1
+			break
+		}
+
+		escaped |= 1 << (i + 1)
+		escapers &^= 3 << i
+	}
+
+	quotes &^= escaped
+
+	// Prefix xor of the quotes marks the characters from an opening quote up to (and
+	// not including) its closing quote.
+	inString := quotes
+	inString ^= inString << 1
+	inString ^= inString << 2
+	inString ^= inString << 4
+	inString ^= inString << 8
+	inString ^= inString << 16
+	inString ^= inString << 32
+	inString ^= si.inString
+	si.inString = uint64(int64(inString) >> 63)
+
+	return operators&^inString | quotes
+}
+
+// structuralIndex holds the positions of the structural characters of an event.
+type structuralIndex struct {
+	positions []uint32
+
+	// match links the position of a bracket to the position of its matching bracket
+	// (both ways), -1 for unmatched brackets and other characters.
+	match []int32
+
+	masks []uint64
+	stack []int32
+}
+
+func (idx *structuralIndex) build(data []byte) {
+	idx.positions = idx.positions[:0]
+
+	full := len(data) / 64 * 64
+	blocks := full / 64
+	if cap(idx.masks) < blocks*3 {
+		idx.masks = make([]uint64, blocks*3)
+	}
+	idx.masks = idx.masks[:blocks*3]
+	classifyBlocks(data[:full], idx.masks)
+
+	var si structuralIndexer
+	for b := 0; b < blocks; b++ {
+		s := si.structurals(idx.masks[b*3], idx.masks[b*3+1], idx.masks[b*3+2])
+		idx.appendPositions(uint32(b*64), s)
+	}
+
+	if full < len(data) {
+		// The tail is padded with spaces into a whole block.
+		var tail [64]byte
+		copy(tail[copy(tail[:], data[full:]):], spaceBlock[:])
+
+		var masks [3]uint64
+		classifyBlocksGeneric(tail[:], masks[:])
+		idx.appendPositions(uint32(full), si.structurals(masks[0], masks[1], masks[2]))
+	}
+
+	idx.linkBrackets(data)
+}
+
+var spaceBlock = [64]byte{' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ',
+	' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ',
+	' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ',
+	' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+
+func (idx *structuralIndex) appendPositions(base uint32, s uint64) {
+	for s != 0 {
+		idx.positions = append(idx.positions, base+uint32(bits.TrailingZeros64(s)))
+		s &= s - 1
+	}
+}
+
+func (idx *structuralIndex) linkBrackets(data []byte) {
+	if cap(idx.match) < len(idx.positions) {
+		idx.match = make([]int32, len(idx.positions))
+	}
+	idx.match = idx.match[:len(idx.positions)]
+	idx.stack = idx.stack[:0]
+
+	for i, pos := range idx.positions {
+		idx.match[i] = -1
+
+		switch c := data[pos]; c {
+		case '{', '[':
+			idx.stack = append(idx.stack, int32(i))
+		case '}', ']':
+			if len(idx.stack) == 0 {
+				continue
+			}
+			open := idx.stack[len(idx.stack)-1]
+			idx.stack = idx.stack[:len(idx.stack)-1]
+
+			// Mismatched brackets are left unmatched, skipping them is an error.
+			if data[idx.positions[open]] == c-2 {
+				idx.match[open] = int32(i)
+				idx.match[i] = open
+			}
+		}
+	}
+}
+
+// structuralTokenizer implements Tokenizer over a structural index.
+//
+//	p is the offset of the next value in data and s the index of the first structural
+//	character at or after p.
+type structuralTokenizer struct {
+	data []byte
+	idx  structuralIndex
+	p    int
+	s    int
+
+	// first is a stack of whether the open objects and arrays are before their first element.
+	first []bool
+
+	key []byte
+}
+
+// NewStructuralTokenizer creates a Tokenizer running on a structural index, see
+// WithStructuralIndex.
+func NewStructuralTokenizer() Tokenizer {
+	return &structuralTokenizer{}
+}
+
+func (t *structuralTokenizer) Reset(data []byte) {
+	t.data = data
+	t.p, t.s = 0, 0
+	t.first = t.first[:0]
+	t.idx.build(data)
+}
+
+// at returns whether the next structural character is at offset p.
+func (t *structuralTokenizer) at(p int) bool {
+	return t.s < len(t.idx.positions) && int(t.idx.positions[t.s]) == p
+}
+
+func (t *structuralTokenizer) skipSpace() byte {
+	t.p = skipJSONSpace(t.data, t.p)
+	if t.p == len(t.data) {
+		return 0
+	}
+	return t.data[t.p]
+}
+
+func (t *structuralTokenizer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("structural: "+format+" at offset %d", append(args, t.p)...)
+}
+
+func (t *structuralTokenizer) Next() jx.Type {
+	switch c := t.skipSpace(); {
+	case c == '{':
+		return jx.Object
+	case c == '[':
+		return jx.Array
+	case c == '"':
+		return jx.String
+	case c == 't' || c == 'f':
+		return jx.Bool
+	case c == 'n':
+		return jx.Null
+	case c == '-' || c >= '0' && c <= '9':
+		return jx.Number
+	}
+	return jx.Invalid
+}
+
+func (t *structuralTokenizer) start(open byte) error {
+	if c := t.skipSpace(); c != open || !t.at(t.p) {
+		return t.errorf("expected %q", open)
+	}
+
+	t.p++
+	t.s++
+	t.first = append(t.first, true)
+	return nil
+}
+
+// more consumes the comma between elements, or the closing bracket which ends them.
+func (t *structuralTokenizer) more(close byte) (bool, error) {
+	c := t.skipSpace()
+	top := len(t.first) - 1
+
+	if c == close && t.at(t.p) {
+		t.p++
+		t.s++
+		t.first = t.first[:top]
+		return false, nil
+	}
+
+	if t.first[top] {
+		t.first[top] = false
+		return true, nil
+	}
+
+	if c != ',' || !t.at(t.p) {
+		return false, t.errorf("expected ',' or %q", close)
+	}
+	t.p++
+	t.s++
+
+	if c := t.skipSpace(); c == close || c == 0 {
+		return false, t.errorf("expected a value")
+	}
+	return true, nil
+}
+
+func (t *structuralTokenizer) ObjStart() error {
+	return t.start('{')
+}
+
+func (t *structuralTokenizer) ObjNext() ([]byte, bool, error) {
+	ok, err := t.more('}')
+	if !ok || err != nil {
+		return nil, false, err
+	}
+
+	// A key is its two quotes and the colon after it.
+	if c := t.skipSpace(); c != '"' || !t.at(t.p) || t.s+2 >= len(t.idx.positions) {
+		return nil, false, t.errorf("expected a key")
+	}
+	end := int(t.idx.positions[t.s+1])
+	colon := int(t.idx.positions[t.s+2])
+	if t.data[colon] != ':' || skipJSONSpace(t.data, end+1) != colon {
+		return nil, false, t.errorf("expected ':' after key")
+	}
+
+	key := t.data[t.p+1 : end]
+	if !isJSONString(key) {
+		return nil, false, t.errorf("invalid key")
+	}
+	if bytes.IndexByte(key, '\\') >= 0 {
+		var err error
+		if key, err = t.unescape(t.data[t.p : end+1]); err != nil {
+			return nil, false, err
+		}
+	}
+
+	t.p = colon + 1
+	t.s += 3
+	return key, true, nil
+}
+
+func (t *structuralTokenizer) unescape(quoted []byte) ([]byte, error) {
+	dcd := jx.GetDecoder()
+	defer jx.PutDecoder(dcd)
+	dcd.ResetBytes(quoted)
+
+	var err error
+	if t.key, err = dcd.StrAppend(t.key[:0]); err != nil {
+		return nil, t.errorf("invalid key: %s", err)
+	}
+	return t.key, nil
+}
+
+func (t *structuralTokenizer) ArrStart() error {
+	return t.start('[')
+}
+
+func (t *structuralTokenizer) ArrNext() (bool, error) {
+	return t.more(']')
+}
+
+func (t *structuralTokenizer) Raw() ([]byte, error) {
+	start := t.p
+	if err := t.Skip(); err != nil {
+		return nil, err
+	}
+
+	raw := t.data[start:t.p]
+	if raw[0] == '"' && !isJSONString(raw[1:len(raw)-1]) {
+		t.p = start
+		return nil, t.errorf("invalid string")
+	}
+	return raw, nil
+}
+
+// skipMeasured is Skip, measured by the offsets around it.
+func (t *structuralTokenizer) skipMeasured() (int, error) {
+	start := t.p
+	err := t.Skip()
+	return t.p - start, err
+}
+
+func (t *structuralTokenizer) Skip() error {
+	c := t.skipSpace()
+
+	switch {
+	case c == '"':
+		if !t.at(t.p) || t.s+1 >= len(t.idx.positions) {
+			return t.errorf("unterminated string")
+		}
+		t.p = int(t.idx.positions[t.s+1]) + 1
+		t.s += 2
+	case c == '{' || c == '[':
+		if !t.at(t.p) || t.idx.match[t.s] < 0 {
+			return t.errorf("unterminated %q", c)
+		}
+		close := int(t.idx.match[t.s])
+		t.p = int(t.idx.positions[close]) + 1
+		t.s = close + 1
+	default:
+		end := t.p
+		for end < len(t.data) && !isJSONDelimiter(t.data[end]) {
+			end++
+		}
+
+		if v := BinaryString(t.data[t.p:end]); v != "true" && v != "false" && v != "null" && !isJSONNumber(v) {
+			return t.errorf("invalid value %q", v)
+		}
+		t.p = end
+	}
+
+	return nil
+}
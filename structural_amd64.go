@@ -0,0 +1,32 @@
+package flattener
+
+import "golang.org/x/sys/cpu"
+
+// classifyAVX2 and classifySSE classify blocks 64 bytes blocks of data into masks, the
+// same as classifyBlocksGeneric. The SSE kernel needs only SSE2, which every amd64 CPU has.
+//
+//go:noescape
+func classifyAVX2(data *byte, blocks int, masks *uint64)
+
+//go:noescape
+func classifySSE(data *byte, blocks int, masks *uint64)
+
+func init() {
+	if cpu.X86.HasAVX2 {
+		classifyBlocks = classifyBlocksAVX2
+	} else {
+		classifyBlocks = classifyBlocksSSE
+	}
+}
+
+func classifyBlocksAVX2(data []byte, masks []uint64) {
+	if len(data) >= 64 {
+		classifyAVX2(&data[0], len(data)/64, &masks[0])
+	}
+}
+
+func classifyBlocksSSE(data []byte, masks []uint64) {
+	if len(data) >= 64 {
+		classifySSE(&data[0], len(data)/64, &masks[0])
+	}
+}
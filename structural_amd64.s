@@ -0,0 +1,162 @@
+#include "textflag.h"
+
+// Every constant is a single byte repeated over 16 bytes.
+DATA backslashes<>+0(SB)/8, $0x5c5c5c5c5c5c5c5c
+DATA backslashes<>+8(SB)/8, $0x5c5c5c5c5c5c5c5c
+GLOBL backslashes<>(SB), RODATA|NOPTR, $16
+
+DATA quotes<>+0(SB)/8, $0x2222222222222222
+DATA quotes<>+8(SB)/8, $0x2222222222222222
+GLOBL quotes<>(SB), RODATA|NOPTR, $16
+
+// ORing 0x20 folds '[' into '{' and ']' into '}'.
+DATA fold<>+0(SB)/8, $0x2020202020202020
+DATA fold<>+8(SB)/8, $0x2020202020202020
+GLOBL fold<>(SB), RODATA|NOPTR, $16
+
+DATA openBraces<>+0(SB)/8, $0x7b7b7b7b7b7b7b7b
+DATA openBraces<>+8(SB)/8, $0x7b7b7b7b7b7b7b7b
+GLOBL openBraces<>(SB), RODATA|NOPTR, $16
+
+DATA closeBraces<>+0(SB)/8, $0x7d7d7d7d7d7d7d7d
+DATA closeBraces<>+8(SB)/8, $0x7d7d7d7d7d7d7d7d
+GLOBL closeBraces<>(SB), RODATA|NOPTR, $16
+
+DATA colons<>+0(SB)/8, $0x3a3a3a3a3a3a3a3a
+DATA colons<>+8(SB)/8, $0x3a3a3a3a3a3a3a3a
+GLOBL colons<>(SB), RODATA|NOPTR, $16
+
+DATA commas<>+0(SB)/8, $0x2c2c2c2c2c2c2c2c
+DATA commas<>+8(SB)/8, $0x2c2c2c2c2c2c2c2c
+GLOBL commas<>(SB), RODATA|NOPTR, $16
+
+// CLASSIFY_AVX2 sets the 32 bits masks of backslashes, quotes and operators of the 32
+// bytes in Y8 into AX, BX and DX.
+#define CLASSIFY_AVX2 \
+	VPCMPEQB  Y0, Y8, Y10 ; \
+	VPMOVMSKB Y10, AX ; \
+	VPCMPEQB  Y1, Y8, Y10 ; \
+	VPMOVMSKB Y10, BX ; \
+	VPOR      Y2, Y8, Y11 ; \
+	VPCMPEQB  Y3, Y11, Y10 ; \
+	VPCMPEQB  Y4, Y11, Y11 ; \
+	VPOR      Y11, Y10, Y10 ; \
+	VPCMPEQB  Y5, Y8, Y11 ; \
+	VPOR      Y11, Y10, Y10 ; \
+	VPCMPEQB  Y6, Y8, Y11 ; \
+	VPOR      Y11, Y10, Y10 ; \
+	VPMOVMSKB Y10, DX
+
+// func classifyAVX2(data *byte, blocks int, masks *uint64)
+TEXT ·classifyAVX2(SB), NOSPLIT, $0-24
+	MOVQ data+0(FP), SI
+	MOVQ blocks+8(FP), CX
+	MOVQ masks+16(FP), DI
+
+	VBROADCASTI128 backslashes<>(SB), Y0
+	VBROADCASTI128 quotes<>(SB), Y1
+	VBROADCASTI128 fold<>(SB), Y2
+	VBROADCASTI128 openBraces<>(SB), Y3
+	VBROADCASTI128 closeBraces<>(SB), Y4
+	VBROADCASTI128 colons<>(SB), Y5
+	VBROADCASTI128 commas<>(SB), Y6
+
+loop:
+	TESTQ CX, CX
+	JZ    done
+
+	// The high half first, its masks are shifted into the upper 32 bits.
+	VMOVDQU 32(SI), Y8
+	CLASSIFY_AVX2
+	SHLQ    $32, AX
+	SHLQ    $32, BX
+	SHLQ    $32, DX
+	MOVQ    AX, R8
+	MOVQ    BX, R9
+	MOVQ    DX, R10
+
+	VMOVDQU (SI), Y8
+	CLASSIFY_AVX2
+	ORQ     R8, AX
+	ORQ     R9, BX
+	ORQ     R10, DX
+
+	MOVQ AX, (DI)
+	MOVQ BX, 8(DI)
+	MOVQ DX, 16(DI)
+
+	ADDQ $64, SI
+	ADDQ $24, DI
+	DECQ CX
+	JMP  loop
+
+done:
+	VZEROUPPER
+	RET
+
+// CLASSIFY_SSE ORs the 16 bits masks of backslashes, quotes and operators of the 16
+// bytes at off(SI), shifted by shift, into R8, R9 and R10.
+#define CLASSIFY_SSE(off, shift) \
+	MOVOU    off(SI), X8 ; \
+	MOVOU    X8, X10 ; \
+	PCMPEQB  X0, X10 ; \
+	PMOVMSKB X10, AX ; \
+	SHLQ     $shift, AX ; \
+	ORQ      AX, R8 ; \
+	MOVOU    X8, X10 ; \
+	PCMPEQB  X1, X10 ; \
+	PMOVMSKB X10, AX ; \
+	SHLQ     $shift, AX ; \
+	ORQ      AX, R9 ; \
+	MOVOU    X8, X11 ; \
+	POR      X2, X11 ; \
+	MOVOU    X11, X10 ; \
+	PCMPEQB  X3, X10 ; \
+	PCMPEQB  X4, X11 ; \
+	POR      X11, X10 ; \
+	MOVOU    X8, X11 ; \
+	PCMPEQB  X5, X11 ; \
+	POR      X11, X10 ; \
+	PCMPEQB  X6, X8 ; \
+	POR      X8, X10 ; \
+	PMOVMSKB X10, AX ; \
+	SHLQ     $shift, AX ; \
+	ORQ      AX, R10
+
+// func classifySSE(data *byte, blocks int, masks *uint64)
+TEXT ·classifySSE(SB), NOSPLIT, $0-24
+	MOVQ data+0(FP), SI
+	MOVQ blocks+8(FP), CX
+	MOVQ masks+16(FP), DI
+
+	MOVOU backslashes<>(SB), X0
+	MOVOU quotes<>(SB), X1
+	MOVOU fold<>(SB), X2
+	MOVOU openBraces<>(SB), X3
+	MOVOU closeBraces<>(SB), X4
+	MOVOU colons<>(SB), X5
+	MOVOU commas<>(SB), X6
+
+sseloop:
+	TESTQ CX, CX
+	JZ    ssedone
+
+	XORQ R8, R8
+	XORQ R9, R9
+	XORQ R10, R10
+	CLASSIFY_SSE(0, 0)
+	CLASSIFY_SSE(16, 16)
+	CLASSIFY_SSE(32, 32)
+	CLASSIFY_SSE(48, 48)
+
+	MOVQ R8, (DI)
+	MOVQ R9, 8(DI)
+	MOVQ R10, 16(DI)
+
+	ADDQ $64, SI
+	ADDQ $24, DI
+	DECQ CX
+	JMP  sseloop
+
+ssedone:
+	RET
@@ -0,0 +1,36 @@
+package flattener
+
+import (
+	"math/rand"
+	"testing"
+
+	"golang.org/x/sys/cpu"
+)
+
+func Test_Structural_Kernels(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 64*50)
+	for i := range data {
+		// Mostly the characters the kernels look for, and their neighbours.
+		data[i] = ("\\\"{}[]:,;<z|" + "\x1a\x0c\x00\xff")[r.Intn(16)]
+	}
+
+	wanted := make([]uint64, len(data)/64*3)
+	classifyBlocksGeneric(data, wanted)
+
+	kernels := map[string]func([]byte, []uint64){"sse": classifyBlocksSSE}
+	if cpu.X86.HasAVX2 {
+		kernels["avx2"] = classifyBlocksAVX2
+	}
+
+	for name, kernel := range kernels {
+		got := make([]uint64, len(wanted))
+		kernel(data, got)
+
+		for i := range wanted {
+			if got[i] != wanted[i] {
+				t.Errorf("%s: block %d mask %d: wanted %064b got %064b", name, i/3, i%3, wanted[i], got[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package flattener
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_Structural_Malformed(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a")
+	paths.Add("b\nc")
+
+	fj := NewJxFlattener(paths, WithStructuralIndex())
+	for _, event := range []string{
+		`[1]`,
+		`{"a": tru}`,
+		`{"a": "unterminated}`,
+		`{"b": {"c": [1, 2}}`,
+		`{"b": {"c": [1,]}}`,
+		`{"b": {"x": {"y": 1]}, "a": 1}`,
+		`{"a": [1 2]}`,
+		`{"a": "bad \x escape"}`,
+		`{"a": "short \u12"}`,
+		"{\"a\": \"control \x01 char\"}",
+		`{"b\q": 1}`,
+	} {
+		if _, err := fj.Flatten([]byte(event), nil); err == nil {
+			t.Errorf("%s: wanted error", event)
+		}
+	}
+}
+
+func Test_Structural_Index(t *testing.T) {
+	// Backslash runs and strings crossing the 64 bytes blocks.
+	for _, n := range []int{61, 62, 63, 64, 65, 127, 128} {
+		key := strings.Repeat("k", n)
+		event := `{"` + key + `": "` + strings.Repeat(`\\`, n) + `\"}{", "x": [1]}`
+
+		var idx structuralIndex
+		idx.build([]byte(event))
+
+		var got []byte
+		for _, pos := range idx.positions {
+			got = append(got, event[pos])
+		}
+		if want := `{"":"","":[]}`; string(got) != want {
+			t.Errorf("%d: wanted structurals %s, got %s", n, want, got)
+		}
+		if idx.match[0] != int32(len(idx.positions)-1) || idx.match[10] != 11 {
+			t.Errorf("%d: wrong brackets %v", n, idx.match)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package flattener
+
+import (
+	"errors"
+
+	"github.com/go-faster/jx"
+)
+
+// Tokenizer is the JSON decoding the traversal of JxFlattener runs on, so the parser can
+// be chosen per workload (see WithTokenizer). Adapters are implemented for jx (the
+// default), the structural index and json-iterator.
+//
+//	Objects and arrays are iterated with ObjNext / ArrNext after ObjStart / ArrStart,
+//	once they return false the object or array is consumed. Raw returns values as they
+//	are in the document (strings with their quotes and escapes), the fields point to
+//	them so they must stay valid after the tokenizer is reset - either a slice of the
+//	document or a copy.
+type Tokenizer interface {
+	// Reset points the tokenizer at a new document.
+	Reset(data []byte)
+
+	// Next peeks at the type of the next value.
+	Next() jx.Type
+
+	ObjStart() error
+	ObjNext() (key []byte, ok bool, err error)
+
+	ArrStart() error
+	ArrNext() (ok bool, err error)
+
+	// Raw returns the next value, Skip consumes it.
+	Raw() ([]byte, error)
+	Skip() error
+}
+
+// WithTokenizer sets the tokenizers the flattener uses, newTokenizer is called whenever
+// the flattener needs one more (documents like embedded JSON are traversed by one of
+// their own), and they are reused afterwards.
+func WithTokenizer(newTokenizer func() Tokenizer) Option {
+	return func(fj *JxFlattener) {
+		fj.newTokenizer = newTokenizer
+	}
+}
+
+// jxTokenizer implements Tokenizer with jx, keeping a stack of the open iterators.
+type jxTokenizer struct {
+	dcd  *jx.Decoder
+	objs []jx.ObjIter
+	arrs []jx.ArrIter
+}
+
+// NewJxTokenizer creates a Tokenizer decoding with jx, the default of JxFlattener.
+func NewJxTokenizer() Tokenizer {
+	return &jxTokenizer{dcd: jx.GetDecoder()}
+}
+
+func (t *jxTokenizer) Reset(data []byte) {
+	t.dcd.ResetBytes(data)
+	t.objs = t.objs[:0]
+	t.arrs = t.arrs[:0]
+}
+
+func (t *jxTokenizer) Next() jx.Type {
+	return t.dcd.Next()
+}
+
+func (t *jxTokenizer) ObjStart() error {
+	iter, err := t.dcd.ObjIter()
+	if err != nil {
+		return err
+	}
+
+	t.objs = append(t.objs, iter)
+	return nil
+}
+
+func (t *jxTokenizer) ObjNext() ([]byte, bool, error) {
+	iter := &t.objs[len(t.objs)-1]
+	if iter.Next() {
+		return iter.Key(), true, nil
+	}
+
+	err := iter.Err()
+	t.objs = t.objs[:len(t.objs)-1]
+	return nil, false, err
+}
+
+func (t *jxTokenizer) ArrStart() error {
+	iter, err := t.dcd.ArrIter()
+	if err != nil {
+		return err
+	}
+
+	t.arrs = append(t.arrs, iter)
+	return nil
+}
+
+func (t *jxTokenizer) ArrNext() (bool, error) {
+	iter := &t.arrs[len(t.arrs)-1]
+	if iter.Next() {
+		return true, nil
+	}
+
+	err := iter.Err()
+	t.arrs = t.arrs[:len(t.arrs)-1]
+	return false, err
+}
+
+func (t *jxTokenizer) Raw() ([]byte, error) {
+	return t.dcd.Raw()
+}
+
+func (t *jxTokenizer) Skip() error {
+	return t.dcd.Skip()
+}
+
+// skipMeasured is Skip measured by the offsets around it: on a byte slice, Raw is Skip
+// returning the document between them. Only its error is wrapped, it's unwrapped so
+// the events fail the same with metrics.
+func (t *jxTokenizer) skipMeasured() (int, error) {
+	raw, err := t.dcd.Raw()
+	if err != nil {
+		return 0, errors.Unwrap(err)
+	}
+	return len(raw), nil
+}
+
+// getTokenizer returns a tokenizer over data, it's returned with putTokenizer once the
+// traversal is done.
+func (fj *JxFlattener) getTokenizer(data []byte) Tokenizer {
+	var t Tokenizer
+	if n := len(fj.tokenizers); n > 0 {
+		t = fj.tokenizers[n-1]
+		fj.tokenizers = fj.tokenizers[:n-1]
+	} else if fj.newTokenizer != nil {
+		t = fj.newTokenizer()
+	} else {
+		t = NewJxTokenizer()
+	}
+
+	t.Reset(data)
+	return t
+}
+
+func (fj *JxFlattener) putTokenizer(t Tokenizer) {
+	fj.tokenizers = append(fj.tokenizers, t)
+}
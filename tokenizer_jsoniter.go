@@ -0,0 +1,109 @@
+package flattener
+
+import (
+	"io"
+	"unsafe"
+
+	"github.com/go-faster/jx"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsoniterTokenizer implements Tokenizer with json-iterator.
+//
+//	json-iterator reads the opening bracket together with the first element, so
+//	ObjStart / ArrStart only check the type and the first ObjNext / ArrNext consume it.
+//	Keys and raw values are copied by json-iterator.
+type jsoniterTokenizer struct {
+	iter *jsoniter.Iterator
+}
+
+// NewJsoniterTokenizer creates a Tokenizer decoding with json-iterator.
+func NewJsoniterTokenizer() Tokenizer {
+	return &jsoniterTokenizer{iter: jsoniter.ParseBytes(jsoniter.ConfigDefault, nil)}
+}
+
+func (t *jsoniterTokenizer) Reset(data []byte) {
+	// ResetBytes keeps the error of the previous document.
+	t.iter.ResetBytes(data)
+	t.iter.Error = nil
+}
+
+func (t *jsoniterTokenizer) Next() jx.Type {
+	switch t.iter.WhatIsNext() {
+	case jsoniter.StringValue:
+		return jx.String
+	case jsoniter.NumberValue:
+		return jx.Number
+	case jsoniter.NilValue:
+		return jx.Null
+	case jsoniter.BoolValue:
+		return jx.Bool
+	case jsoniter.ArrayValue:
+		return jx.Array
+	case jsoniter.ObjectValue:
+		return jx.Object
+	}
+	return jx.Invalid
+}
+
+func (t *jsoniterTokenizer) ObjStart() error {
+	if t.Next() != jx.Object {
+		return t.errorf("ObjStart", "expected an object")
+	}
+	return nil
+}
+
+func (t *jsoniterTokenizer) ObjNext() ([]byte, bool, error) {
+	key := t.iter.ReadObject()
+	if t.iter.Error != nil {
+		return nil, false, t.iter.Error
+	}
+
+	// ReadObject returns an empty string for both an empty key and the end of the object,
+	// only an empty key is followed by a value. Peeking past the end of the root object
+	// reaches the end of the document, that io.EOF is ours and not an error of the event.
+	if key == "" && t.iter.WhatIsNext() == jsoniter.InvalidValue {
+		if t.iter.Error == io.EOF {
+			t.iter.Error = nil
+		}
+		return nil, false, t.iter.Error
+	}
+
+	return stringBytes(key), true, nil
+}
+
+func (t *jsoniterTokenizer) ArrStart() error {
+	if t.Next() != jx.Array {
+		return t.errorf("ArrStart", "expected an array")
+	}
+	return nil
+}
+
+func (t *jsoniterTokenizer) ArrNext() (bool, error) {
+	ok := t.iter.ReadArray()
+	return ok, t.iter.Error
+}
+
+func (t *jsoniterTokenizer) Raw() ([]byte, error) {
+	raw := t.iter.SkipAndReturnBytes()
+	return raw, t.iter.Error
+}
+
+func (t *jsoniterTokenizer) Skip() error {
+	t.iter.Skip()
+	return t.iter.Error
+}
+
+func (t *jsoniterTokenizer) errorf(op string, msg string) error {
+	t.iter.ReportError(op, msg)
+	return t.iter.Error
+}
+
+// stringBytes is the opposite of BinaryString, it returns the bytes of s without a copy,
+// they must not be modified.
+func stringBytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
+}
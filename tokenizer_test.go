@@ -0,0 +1,205 @@
+package flattener
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomJSON writes a random object, biased towards what trips a structural index:
+// escapes, brackets and quotes inside strings and whitespace between tokens.
+type randomJSON struct {
+	r     *rand.Rand
+	b     strings.Builder
+	paths map[string]bool
+}
+
+var randomKeys = []string{"a", "b", "id", "tags", "geo", `q"k`, `s\k`, "{", "x y"}
+
+var randomStrings = []string{
+	`plain`, `with \"quotes\"`, `back\\slash\\`, `\\\\`, `\\\"`, `{[}]:,`, `unicode é é`, `tab\t`, ``, `\/`,
+	strings.Repeat(`\\`, 33), strings.Repeat(`x`, 70) + `\"`,
+}
+
+func (g *randomJSON) space() {
+	for i := g.r.Intn(4); i > 0; i-- {
+		g.b.WriteByte(" \n\t\r"[g.r.Intn(4)])
+	}
+}
+
+func (g *randomJSON) object(path string, depth int) {
+	g.b.WriteByte('{')
+	for i, n := 0, g.r.Intn(5); i < n; i++ {
+		if i > 0 {
+			g.b.WriteByte(',')
+		}
+		g.space()
+
+		key := randomKeys[g.r.Intn(len(randomKeys))]
+		fmt.Fprintf(&g.b, "%q", key)
+		g.space()
+		g.b.WriteByte(':')
+		g.space()
+
+		keyPath := key
+		if path != "" {
+			keyPath = path + "\n" + key
+		}
+		g.value(keyPath, depth+1)
+		g.space()
+	}
+	g.b.WriteByte('}')
+}
+
+func (g *randomJSON) value(path string, depth int) {
+	switch n := g.r.Intn(10); {
+	case n < 2 && depth < 5:
+		g.object(path, depth)
+		return
+	case n < 4 && depth < 5:
+		g.b.WriteByte('[')
+		for i, n := 0, g.r.Intn(5); i < n; i++ {
+			if i > 0 {
+				g.b.WriteByte(',')
+			}
+			g.space()
+			g.value(path, depth+1)
+			g.space()
+		}
+		g.b.WriteByte(']')
+	case n < 7:
+		fmt.Fprintf(&g.b, `"%s"`, randomStrings[g.r.Intn(len(randomStrings))])
+	case n < 8:
+		g.b.WriteString([]string{"0", "-1.5", "12e-3", "123456789012345678901234567890"}[g.r.Intn(4)])
+	default:
+		g.b.WriteString([]string{"true", "false", "null"}[g.r.Intn(3)])
+	}
+	g.paths[path] = true
+}
+
+func Test_Tokenizers_MatchJX(t *testing.T) {
+	tokenizers := map[string]func() Tokenizer{
+		"structural": NewStructuralTokenizer,
+		"jsoniter":   NewJsoniterTokenizer,
+	}
+
+	g := &randomJSON{r: rand.New(rand.NewSource(1)), paths: make(map[string]bool)}
+
+	for i := 0; i < 2000; i++ {
+		g.b.Reset()
+		g.space()
+		g.object("", 0)
+		g.space()
+		event := []byte(g.b.String())
+
+		// Index a random half of the paths seen so far.
+		paths := NewPaths()
+		for path := range g.paths {
+			if g.r.Intn(2) == 0 {
+				paths.Add(path)
+			}
+		}
+
+		jxFields, jxErr := NewJxFlattener(paths).Flatten(event, nil)
+		for name, newTokenizer := range tokenizers {
+			fields, err := NewJxFlattener(paths, WithTokenizer(newTokenizer)).Flatten(event, nil)
+			if (err != nil) != (jxErr != nil) {
+				t.Fatalf("%s: wanted error %v, got %v for %s", name, jxErr, err, event)
+			}
+			if got, wanted := fieldsSet(fields), fieldsSet(jxFields); got != wanted {
+				t.Fatalf("%s: fields differ for %s\ngot:    %s\nwanted: %s", name, event, got, wanted)
+			}
+		}
+	}
+}
+
+func Test_Tokenizers_Malformed(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a\nb")
+
+	for name, newTokenizer := range map[string]func() Tokenizer{
+		"jx":         NewJxTokenizer,
+		"structural": NewStructuralTokenizer,
+		"jsoniter":   NewJsoniterTokenizer,
+	} {
+		fj := NewJxFlattener(paths, WithTokenizer(newTokenizer))
+		for _, event := range []string{
+			`{"x": 1 "a": 2}`,
+			`{"a": {"b": 1`,
+			`{"a": {"x": 1 "b": 2}}`,
+			`{"a": {"": 1 "b": 2}}`,
+		} {
+			if _, err := fj.Flatten([]byte(event), nil); err == nil {
+				t.Errorf("%s: %s: wanted error", name, event)
+			}
+		}
+
+		// An empty key is a key, not the end of the object.
+		fields, err := fj.Flatten([]byte(`{"": 1, "a": {"": {}, "b": 2}}`), nil)
+		if err != nil {
+			t.Fatalf("%s: Flatten: %s", name, err)
+		}
+		if got, wanted := fieldsSet(fields), `["a\nb"=2 []]`; got != wanted {
+			t.Errorf("%s: wanted %s got %s", name, wanted, got)
+		}
+	}
+}
+
+func Test_Tokenizers_Embedded(t *testing.T) {
+	// Embedded documents are traversed by tokenizers of their own.
+	paths := NewPaths()
+	paths.Add("Message\norderId")
+	paths.Add("Type")
+	paths.AddEmbeddedJSON("Message")
+
+	wanted := `["Message\norderId"="o-17" []]["Type"="Notification" []]`
+	for _, fj := range []*JxFlattener{
+		NewJxFlattener(paths, WithStructuralIndex()),
+		NewJxFlattener(paths, WithTokenizer(NewJsoniterTokenizer)),
+	} {
+		for _, f := range []*JxFlattener{fj, fj.Copy().(*JxFlattener)} {
+			fields, err := f.Flatten([]byte(snsNotification), nil)
+			if err != nil {
+				t.Fatal("Flatten: " + err.Error())
+			}
+			if got := fieldsSet(fields); got != wanted {
+				t.Errorf("wanted %s got %s", wanted, got)
+			}
+		}
+	}
+}
+
+func Benchmark_Tokenizers(b *testing.B) {
+	// A typical geometry: few indexed fields and a large array which is skipped.
+	var coordinates strings.Builder
+	for i := 0; i < 500; i++ {
+		if i > 0 {
+			coordinates.WriteString(", ")
+		}
+		fmt.Fprintf(&coordinates, "[ -122.%d, 37.%d, 0.0 ]", int64(418114728237924)+int64(i), int64(807058866808987)+int64(i))
+	}
+	event := []byte(`{ "type": "Feature", "geometry": { "type": "Polygon", "coordinates": [ [ ` + coordinates.String() +
+		` ] ] }, "properties": { "STREET": "CRANLEIGH", "LOT_NUM": "001" } }`)
+
+	paths := NewPaths()
+	paths.Add("properties\nSTREET")
+	paths.Add("type")
+
+	for name, fj := range map[string]*JxFlattener{
+		"jx":         NewJxFlattener(paths),
+		"structural": NewJxFlattener(paths, WithStructuralIndex()),
+		"jsoniter":   NewJxFlattener(paths, WithTokenizer(NewJsoniterTokenizer)),
+	} {
+		fj := fj
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(event)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := fj.Flatten(event, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
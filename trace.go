@@ -0,0 +1,148 @@
+package flattener
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/timbray/quamina"
+)
+
+// Tracer receives the steps of flattening an event, for debugging which keys were
+// matched or skipped and why fields were (not) emitted. See WithTracer and
+// FlattenTraced.
+//
+//	A tracer given with WithTracer is shared by the copies of the flattener, so it has
+//	to be safe for concurrent use. The slices of a TraceEvent are only valid during the
+//	call.
+type Tracer interface {
+	Trace(e TraceEvent)
+}
+
+// TracerFunc is a Tracer calling a function.
+type TracerFunc func(e TraceEvent)
+
+func (f TracerFunc) Trace(e TraceEvent) {
+	f(e)
+}
+
+type TraceKind int
+
+const (
+	// TraceEnterNode starts traversing an object of the PathIndex, Nodes and Fields are
+	// the number of nodes and fields it looks for.
+	TraceEnterNode TraceKind = iota
+	// TraceLeaveNode ends it, Stopped is set when all the nodes were found before the end
+	// of the object.
+	TraceLeaveNode
+	// TraceKeyMatched and TraceKeySkipped report whether the value of Key is parsed.
+	TraceKeyMatched
+	TraceKeySkipped
+	// TraceField reports an emitted field.
+	TraceField
+	// TraceArrayStep moves to the next element of the array at the end of
+	// Field.ArrayTrail, Field.Path is the path of the array.
+	TraceArrayStep
+)
+
+func (k TraceKind) String() string {
+	switch k {
+	case TraceEnterNode:
+		return "enter node"
+	case TraceLeaveNode:
+		return "leave node"
+	case TraceKeyMatched:
+		return "key matched"
+	case TraceKeySkipped:
+		return "key skipped"
+	case TraceField:
+		return "field"
+	case TraceArrayStep:
+		return "array step"
+	}
+	return fmt.Sprintf("TraceKind(%d)", int(k))
+}
+
+// TraceEvent is a single step, Depth is the number of objects it's inside of.
+type TraceEvent struct {
+	Kind  TraceKind
+	Depth int
+
+	Key []byte
+
+	Nodes   int
+	Fields  int
+	Stopped bool
+
+	Field quamina.Field
+}
+
+// WithTracer reports the steps of flattening every event to t.
+func WithTracer(t Tracer) Option {
+	return func(fj *JxFlattener) {
+		fj.tracer = t
+	}
+}
+
+// FlattenTraced is Flatten reporting the steps of this event to t, instead of the tracer
+// of the flattener (if any).
+func (fj *JxFlattener) FlattenTraced(event []byte, t Tracer) ([]quamina.Field, error) {
+	tracer := fj.tracer
+	fj.tracer = t
+	defer func() { fj.tracer = tracer }()
+
+	return fj.Flatten(event, nil)
+}
+
+func (fj *JxFlattener) traceKey(key []byte, matched bool) {
+	kind := TraceKeySkipped
+	if matched {
+		kind = TraceKeyMatched
+	}
+	fj.tracer.Trace(TraceEvent{Kind: kind, Depth: fj.depth, Key: key})
+}
+
+// NewLogTracer returns a Tracer writing every step as a line of l, indented by its depth.
+func NewLogTracer(l *log.Logger) Tracer {
+	return TracerFunc(func(e TraceEvent) {
+		indent := ""
+		if e.Depth > 1 {
+			indent = strings.Repeat("  ", e.Depth-1)
+		}
+
+		switch e.Kind {
+		case TraceEnterNode:
+			l.Printf("%s%s (nodes: %d, fields: %d)", indent, e.Kind, e.Nodes, e.Fields)
+		case TraceLeaveNode:
+			if e.Stopped {
+				l.Printf("%s%s (stopped, all nodes found)", indent, e.Kind)
+			} else {
+				l.Printf("%s%s", indent, e.Kind)
+			}
+		case TraceKeyMatched, TraceKeySkipped:
+			l.Printf("%s  %s %q", indent, e.Kind, e.Key)
+		case TraceField:
+			l.Printf("%s  %s %s = %s%s", indent, e.Kind, tracePath(e.Field.Path), e.Field.Val, traceTrail(e.Field.ArrayTrail))
+		case TraceArrayStep:
+			l.Printf("%s  %s %s%s", indent, e.Kind, tracePath(e.Field.Path), traceTrail(e.Field.ArrayTrail))
+		default:
+			l.Printf("%s%s", indent, e.Kind)
+		}
+	})
+}
+
+func tracePath(path []byte) string {
+	return strings.ReplaceAll(string(path), PATH_SEPARATOR, "->")
+}
+
+func traceTrail(trail []quamina.ArrayPos) string {
+	if len(trail) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(trail))
+	for i, pos := range trail {
+		parts[i] = fmt.Sprintf("%d:%d", pos.Array, pos.Pos)
+	}
+	return " [" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,115 @@
+package flattener
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+// traceLines renders the steps of flattening an event.
+func traceLines(t *testing.T, fj *JxFlattener, event string) []string {
+	t.Helper()
+
+	var lines []string
+	_, err := fj.FlattenTraced([]byte(event), TracerFunc(func(e TraceEvent) {
+		switch e.Kind {
+		case TraceEnterNode:
+			lines = append(lines, fmt.Sprintf("%d %s %d/%d", e.Depth, e.Kind, e.Nodes, e.Fields))
+		case TraceLeaveNode:
+			lines = append(lines, fmt.Sprintf("%d %s %v", e.Depth, e.Kind, e.Stopped))
+		case TraceKeyMatched, TraceKeySkipped:
+			lines = append(lines, fmt.Sprintf("%d %s %s", e.Depth, e.Kind, e.Key))
+		case TraceField, TraceArrayStep:
+			lines = append(lines, fmt.Sprintf("%d %s %s=%s%s", e.Depth, e.Kind, tracePath(e.Field.Path), e.Field.Val, traceTrail(e.Field.ArrayTrail)))
+		}
+	}))
+	if err != nil {
+		t.Fatal("FlattenTraced: " + err.Error())
+	}
+	return lines
+}
+
+func Test_Trace_Steps(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a\nb")
+	paths.Add("c")
+
+	fj := NewJxFlattener(paths)
+	got := traceLines(t, fj, `{"x": 1, "a": {"b": [1, 2], "z": {}}, "c": "v"}`)
+
+	wanted := []string{
+		"1 enter node 1/1",
+		"1 key skipped x",
+		"1 key matched a",
+		"2 enter node 0/1",
+		"2 key matched b",
+		"2 array step a->b= [1:1]",
+		"2 field a->b=1 [1:1]",
+		"2 array step a->b= [1:2]",
+		"2 field a->b=2 [1:2]",
+		"2 key skipped z",
+		"2 leave node false",
+		"1 key matched c",
+		"1 field c=\"v\"",
+		"1 leave node false",
+	}
+	if strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+		t.Errorf("wanted:\n%s\ngot:\n%s", strings.Join(wanted, "\n"), strings.Join(got, "\n"))
+	}
+
+	// The tracer is only used for the call.
+	if fj.tracer != nil {
+		t.Error("wanted FlattenTraced to restore the tracer")
+	}
+}
+
+func Test_Trace_StoppedNodes(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a\nb\nc")
+
+	got := traceLines(t, NewJxFlattener(paths), `{"a": {"b": {"c": 1}, "rest": 2}, "after": 3}`)
+
+	// b is done once c is found, so the rest of a is drained and the root stops.
+	wanted := []string{
+		"1 enter node 1/0",
+		"1 key matched a",
+		"2 enter node 1/0",
+		"2 key matched b",
+		"3 enter node 0/1",
+		"3 key matched c",
+		"3 field a->b->c=1",
+		"3 leave node false",
+		"2 key skipped rest",
+		"2 leave node true",
+		"1 leave node true",
+	}
+	if strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+		t.Errorf("wanted:\n%s\ngot:\n%s", strings.Join(wanted, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func Test_Trace_LogTracer(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("a\nb")
+
+	var out bytes.Buffer
+	fj := NewJxFlattener(paths, WithTracer(NewLogTracer(log.New(&out, "", 0))))
+	if _, err := fj.Copy().Flatten([]byte(`{"a": {"b": ["x"]}, "z": 1}`), nil); err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	wanted := `enter node (nodes: 1, fields: 0)
+  key matched "a"
+  enter node (nodes: 0, fields: 1)
+    key matched "b"
+    array step a->b [1:1]
+    field a->b = "x" [1:1]
+  leave node
+leave node (stopped, all nodes found)
+`
+	if out.String() != wanted {
+		t.Errorf("wanted:\n%s\ngot:\n%s", wanted, out.String())
+	}
+}
@@ -0,0 +1,191 @@
+package flattener
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/timbray/quamina"
+)
+
+// XMLFlattener flattens XML documents, the document is treated as a JSON object holding
+// the root element, so <order><id>1</id></order> is matched by {"order": {"id": ["1"]}}.
+//
+//	Attributes are fields named by attrPrefix and the attribute name (e.g. "@id"), the text
+//	of an element is both the value of the element itself and of its textKey field.
+//	Repeated sibling elements are an array. Elements which are not in the index are
+//	skipped without being decoded.
+type XMLFlattener struct {
+	paths      PathIndex
+	attrPrefix string
+	textKey    string
+
+	fields     []quamina.Field
+	arrayCount int32
+	buf        []byte
+	text       []byte
+}
+
+// NewXMLFlattener creates a flattener for XML documents, emitting the fields in paths.
+// attrPrefix and textKey name attributes and the text of elements (e.g. "@" and "#text").
+func NewXMLFlattener(paths PathIndex, attrPrefix string, textKey string) *XMLFlattener {
+	return &XMLFlattener{
+		paths:      paths,
+		attrPrefix: attrPrefix,
+		textKey:    textKey,
+		fields:     make([]quamina.Field, 0),
+		arrayCount: 0,
+	}
+}
+
+func (fx *XMLFlattener) Copy() quamina.Flattener {
+	return NewXMLFlattener(fx.paths, fx.attrPrefix, fx.textKey)
+}
+
+func (fx *XMLFlattener) reset() {
+	fx.arrayCount = 0
+	fx.fields = fx.fields[:0]
+	fx.buf = fx.buf[:0]
+}
+
+func (fx *XMLFlattener) Flatten(event []byte, tracker quamina.NameTracker) ([]quamina.Field, error) {
+	fx.reset()
+
+	d := xml.NewDecoder(bytes.NewReader(event))
+
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return fx.fields, errors.New("xml: no root element")
+		}
+		if err != nil {
+			return fx.fields, fmt.Errorf("xml: %s", err)
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			if err := fx.traverseElement(d, start, fx.paths); err != nil {
+				return fx.fields, err
+			}
+			return fx.fields, nil
+		}
+	}
+}
+
+// xmlSiblings tracks the occurrences of a child element name, and the fields emitted for each.
+type xmlSiblings struct {
+	name   string
+	ranges [][2]int
+}
+
+// Traverse an element, parent is the node holding it.
+func (fx *XMLFlattener) traverseElement(d *xml.Decoder, start xml.StartElement, parent Node) error {
+	name := start.Name.Local
+	path, isField := parent.getFields()[name]
+	node, isNode := parent.get(name)
+
+	if !isField && !isNode {
+		return d.Skip()
+	}
+
+	var nodeFields map[string][]byte
+	var textPath []byte
+	if isNode {
+		nodeFields = node.getFields()
+		textPath = nodeFields[fx.textKey]
+
+		for _, attr := range start.Attr {
+			if attrPath, ok := nodeFields[fx.attrPrefix+attr.Name.Local]; ok {
+				fx.storeString(attrPath, attr.Value)
+			}
+		}
+	}
+
+	collectText := isField || textPath != nil
+	textStart := len(fx.text)
+	defer func() {
+		fx.text = fx.text[:textStart]
+	}()
+
+	var siblings []xmlSiblings
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return fmt.Errorf("xml: in <%s>: %s", name, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.CharData:
+			if collectText {
+				fx.text = append(fx.text, t...)
+			}
+
+		case xml.StartElement:
+			if !isNode {
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			first := len(fx.fields)
+			if err := fx.traverseElement(d, t, node); err != nil {
+				return err
+			}
+			siblings = addXMLSibling(siblings, t.Name.Local, first, len(fx.fields))
+
+		case xml.EndElement:
+			text := string(bytes.TrimSpace(fx.text[textStart:]))
+			if isField {
+				fx.storeString(path, text)
+			}
+			if textPath != nil {
+				fx.storeString(textPath, text)
+			}
+
+			fx.markArrays(siblings)
+			return nil
+		}
+	}
+}
+
+func addXMLSibling(siblings []xmlSiblings, name string, first int, last int) []xmlSiblings {
+	for i := range siblings {
+		if siblings[i].name == name {
+			siblings[i].ranges = append(siblings[i].ranges, [2]int{first, last})
+			return siblings
+		}
+	}
+	return append(siblings, xmlSiblings{name: name, ranges: [][2]int{{first, last}}})
+}
+
+// markArrays turns elements repeated under the same parent into an array.
+//
+//	We only know an element repeats once its parent is closed, by then the fields of
+//	its subtree are already emitted, so the array position is put in front of their
+//	trails - enclosing arrays are closed later and end up in front of it.
+func (fx *XMLFlattener) markArrays(siblings []xmlSiblings) {
+	for _, s := range siblings {
+		if len(s.ranges) < 2 {
+			continue
+		}
+
+		fx.arrayCount++
+		for i, r := range s.ranges {
+			pos := quamina.ArrayPos{Array: fx.arrayCount, Pos: int32(i + 1)}
+			for f := r[0]; f < r[1]; f++ {
+				trail := make([]quamina.ArrayPos, 0, len(fx.fields[f].ArrayTrail)+1)
+				trail = append(trail, pos)
+				fx.fields[f].ArrayTrail = append(trail, fx.fields[f].ArrayTrail...)
+			}
+		}
+	}
+}
+
+func (fx *XMLFlattener) storeString(path []byte, value string) {
+	start := len(fx.buf)
+	fx.buf = appendJSONString(fx.buf, value, false)
+	fx.fields = append(fx.fields, quamina.Field{Path: path, Val: fx.buf[start:len(fx.buf):len(fx.buf)]})
+}
@@ -0,0 +1,93 @@
+package flattener
+
+import (
+	"testing"
+
+	"github.com/timbray/quamina"
+)
+
+const xmlOrder = `<?xml version="1.0"?>
+<order id="17" region="eu">
+  <customer vip="true">
+    <name>Yosi &amp; Co</name>
+    <notes><note>ignored</note></notes>
+  </customer>
+  <items>
+    <item sku="a-1"><qty>2</qty></item>
+    <item sku="b-2"><qty>5</qty></item>
+  </items>
+  <comment lang="en">  fragile  </comment>
+</order>`
+
+func Test_XML_Flatten(t *testing.T) {
+	paths := NewPaths()
+	for _, path := range []string{
+		"order\n@id",
+		"order\ncustomer\nname",
+		"order\ncustomer\n@vip",
+		"order\nitems\nitem\n@sku",
+		"order\nitems\nitem\nqty",
+		"order\ncomment\n#text",
+		"order\ncomment\n@lang",
+	} {
+		paths.Add(path)
+	}
+
+	fields, err := NewXMLFlattener(paths, "@", "#text").Flatten([]byte(xmlOrder), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	item := func(pos int32) []quamina.ArrayPos {
+		return []quamina.ArrayPos{{Array: 1, Pos: pos}}
+	}
+	wanted := []quamina.Field{
+		{Path: []byte("order\n@id"), Val: []byte(`"17"`)},
+		{Path: []byte("order\ncustomer\n@vip"), Val: []byte(`"true"`)},
+		{Path: []byte("order\ncustomer\nname"), Val: []byte(`"Yosi & Co"`)},
+		{Path: []byte("order\nitems\nitem\n@sku"), Val: []byte(`"a-1"`), ArrayTrail: item(1)},
+		{Path: []byte("order\nitems\nitem\nqty"), Val: []byte(`"2"`), ArrayTrail: item(1)},
+		{Path: []byte("order\nitems\nitem\n@sku"), Val: []byte(`"b-2"`), ArrayTrail: item(2)},
+		{Path: []byte("order\nitems\nitem\nqty"), Val: []byte(`"5"`), ArrayTrail: item(2)},
+		{Path: []byte("order\ncomment\n@lang"), Val: []byte(`"en"`)},
+		{Path: []byte("order\ncomment\n#text"), Val: []byte(`"fragile"`)},
+	}
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+}
+
+func Test_XML_NestedArrays(t *testing.T) {
+	doc := `<r><g><v>1</v><v>2</v></g><g><v>3</v></g></r>`
+
+	paths := NewPaths()
+	paths.Add("r\ng\nv")
+
+	fields, err := NewXMLFlattener(paths, "@", "#text").Flatten([]byte(doc), nil)
+	if err != nil {
+		t.Fatal("Flatten: " + err.Error())
+	}
+
+	// The inner array is closed first, so it gets the lower array number.
+	wanted := []quamina.Field{
+		{Path: []byte("r\ng\nv"), Val: []byte(`"1"`), ArrayTrail: []quamina.ArrayPos{{Array: 2, Pos: 1}, {Array: 1, Pos: 1}}},
+		{Path: []byte("r\ng\nv"), Val: []byte(`"2"`), ArrayTrail: []quamina.ArrayPos{{Array: 2, Pos: 1}, {Array: 1, Pos: 2}}},
+		{Path: []byte("r\ng\nv"), Val: []byte(`"3"`), ArrayTrail: []quamina.ArrayPos{{Array: 2, Pos: 2}}},
+	}
+	if got, want := fieldsSet(fields), fieldsSet(wanted); got != want {
+		t.Errorf("wrong fields\ngot:    %s\nwanted: %s", got, want)
+	}
+}
+
+func Test_XML_Malformed(t *testing.T) {
+	paths := NewPaths()
+	paths.Add("order\nid")
+
+	fx := NewXMLFlattener(paths, "@", "#text")
+	if _, err := fx.Flatten([]byte(`<order><id>1</order>`), nil); err == nil {
+		t.Error("wanted error on mismatched tags")
+	}
+	if _, err := fx.Flatten([]byte(`just text`), nil); err == nil {
+		t.Error("wanted error without root element")
+	}
+}